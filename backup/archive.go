@@ -0,0 +1,564 @@
+// Package backup
+package backup
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+)
+
+// ArchiveOptions controls how new archives are written.
+type ArchiveOptions struct {
+	Compression *config.Compression // nil uses gzip
+	Encryption  *config.Encryption  // nil writes plain archives
+	DryRun      bool                // only report what would be written and deleted
+}
+
+// withCompression returns opts with the compression overridden by an item's
+// own setting, if it has one.
+func (opts ArchiveOptions) withCompression(c *config.Compression) ArchiveOptions {
+	if c != nil {
+		opts.Compression = c
+	}
+	return opts
+}
+
+// archiveWriter streams files into a compressed tar archive. Data is written to a
+// temporary file next to the target which is renamed into place by Commit,
+// so a failed or interrupted run never leaves a truncated archive behind.
+type archiveWriter struct {
+	targetPath string
+	file       *os.File
+	enc        io.WriteCloser // encryption layer between compression and file
+	comp       io.WriteCloser // compression layer between tar and encryption
+	tw         *tar.Writer
+	links      map[fileID]string // first archived name of every multiply-linked file
+	snapshot   *snapshotBuilder  // if set, unchanged files are left out
+}
+
+// createArchive starts a new archive that will be stored at targetPath.
+func createArchive(targetPath string, opts ArchiveOptions) (*archiveWriter, error) {
+	file, err := os.CreateTemp(filepath.Dir(targetPath), tempPattern(filepath.Base(targetPath)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary archive for %s: %w", targetPath, err)
+	}
+	enc, err := encryptWriter(file, opts.Encryption)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to set up encryption for %s: %w", targetPath, err)
+	}
+
+	comp, err := compressWriter(enc, opts.Compression)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to set up compression for %s: %w", targetPath, err)
+	}
+	return &archiveWriter{
+		targetPath: targetPath,
+		file:       file,
+		enc:        enc,
+		comp:       comp,
+		tw:         tar.NewWriter(comp),
+		links:      make(map[fileID]string),
+	}, nil
+}
+
+// addTree archives baseDir/entryName recursively. Entry names in the archive
+// are relative to baseDir, as with "tar -C baseDir entryName". A non-nil filter
+// decides which entries below the root are left out.
+func (a *archiveWriter) addTree(baseDir, entryName string, filter *pathFilter) error {
+	return walkTree(baseDir, entryName, filter, a.addPath)
+}
+
+// walkTree calls visit for baseDir/entryName and everything below it that passes
+// filter, parents before children, with names relative to baseDir.
+func walkTree(baseDir, entryName string, filter *pathFilter, visit func(fullPath, name string) error) error {
+	root := filepath.Join(baseDir, entryName)
+	includedDirs := make(map[string]bool) // directories matched by an include pattern
+	written := make(map[string]bool)      // directory entries already in the archive
+
+	// writeParents adds the not yet written ancestors of rel (directories are
+	// written lazily when an include list is used, to avoid empty skeletons)
+	writeParents := func(rel string) error {
+		var missing []string
+		for dir := path.Dir(rel); dir != "." && !written[dir]; dir = path.Dir(dir) {
+			missing = append(missing, dir)
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			dir := missing[i]
+			if err := visit(filepath.Join(root, filepath.FromSlash(dir)), path.Join(entryName, dir)); err != nil {
+				return err
+			}
+			written[dir] = true
+		}
+		return nil
+	}
+
+	return filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking %s: %w", fullPath, err)
+		}
+		relPath, err := filepath.Rel(baseDir, fullPath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for %s: %w", fullPath, err)
+		}
+		name := filepath.ToSlash(relPath)
+
+		if filter == nil {
+			return visit(fullPath, name)
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, entryName), "/")
+		if rel == "" {
+			written["."] = true
+			if d.IsDir() {
+				if err := filter.loadIgnoreFile("."); err != nil {
+					return err
+				}
+			}
+			return visit(fullPath, name)
+		}
+
+		if filter.excluded(rel, d.IsDir()) {
+			filter.Excluded++
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		included := includedDirs[path.Dir(rel)] || filter.included(rel, d.IsDir())
+		if d.IsDir() {
+			if err := filter.loadIgnoreFile(rel); err != nil {
+				return err
+			}
+			if !included {
+				// Keep walking: files further down may still match an include pattern
+				return nil
+			}
+			includedDirs[rel] = true
+		} else if !included {
+			filter.Excluded++
+			return nil
+		}
+
+		if err := writeParents(rel); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			written[rel] = true
+		}
+		return visit(fullPath, name)
+	})
+}
+
+// addPath writes a single file system object under the given archive name.
+func (a *archiveWriter) addPath(fullPath, name string) error {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", fullPath, err)
+	}
+
+	if info.Mode()&os.ModeSocket != 0 {
+		fmt.Printf("⚠️ Skipping socket %s\n", fullPath)
+		return nil
+	}
+	if a.snapshot != nil && !a.snapshot.changed(name, info) {
+		return nil
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(fullPath); err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", fullPath, err)
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("failed to build tar header for %s: %w", fullPath, err)
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	// Store additional names of hard-linked files as links to the first one
+	if info.Mode().IsRegular() {
+		if id, ok := hardlinkID(info); ok {
+			if first, seen := a.links[id]; seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				a.links[id] = name
+			}
+		}
+	}
+
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", fullPath, err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	src, err := os.Open(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", fullPath, err)
+	}
+	defer src.Close()
+
+	written, err := io.Copy(a.tw, src)
+	if err != nil {
+		return fmt.Errorf("error archiving %s: %w", fullPath, err)
+	}
+	if written != hdr.Size {
+		return fmt.Errorf("%s changed size while being archived (%d of %d bytes)", fullPath, written, hdr.Size)
+	}
+	return nil
+}
+
+// addBytes writes an in-memory regular file under the given archive name.
+func (a *archiveWriter) addBytes(name string, data []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+	}
+	if _, err := a.tw.Write(data); err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	return nil
+}
+
+// Commit flushes the archive and atomically moves it to its final name.
+func (a *archiveWriter) Commit() error {
+	err := a.tw.Close()
+	if err == nil {
+		err = a.comp.Close()
+	}
+	if err == nil {
+		err = a.enc.Close()
+	}
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(a.file.Name(), a.targetPath)
+	}
+	if err != nil {
+		os.Remove(a.file.Name())
+		return fmt.Errorf("failed to finalize archive %s: %w", a.targetPath, err)
+	}
+	return nil
+}
+
+// Abort discards the partially written archive.
+func (a *archiveWriter) Abort() {
+	a.file.Close()
+	os.Remove(a.file.Name())
+}
+
+// openArchive opens an archive for reading, decrypting it with the keys from enc
+// if it is encrypted and detecting its compression from the content.
+// Closing the returned closer releases the file.
+func openArchive(archivePath string, enc *config.Encryption) (*tar.Reader, io.Closer, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open archive %s: %w", archivePath, err)
+	}
+	plain, err := decryptReader(file, enc)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to decrypt %s: %w", archivePath, err)
+	}
+	dec, err := decompressReader(plain)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to read compressed stream of %s: %w", archivePath, err)
+	}
+	return tar.NewReader(dec), multiCloser{dec, file}, nil
+}
+
+// verifyArchive checks that the archive at archivePath can be read: its first
+// tar header is read through the decryption and decompression layers. Age
+// archives can only be decrypted with an identityFile; without one, only
+// their age header is checked.
+func verifyArchive(archivePath string, enc *config.Encryption) error {
+	if enc != nil && strings.ToLower(enc.Type) == EncryptionAge && enc.IdentityFile == "" {
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		head := make([]byte, len(ageMagic))
+		if _, err := io.ReadFull(file, head); err != nil || string(head) != ageMagic {
+			return fmt.Errorf("not an age-encrypted archive")
+		}
+		return nil
+	}
+
+	tr, closer, err := openArchive(archivePath, enc)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	if _, err := tr.Next(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", archivePath, err)
+	}
+	return nil
+}
+
+// multiCloser closes several closers in order, returning the first error.
+type multiCloser []io.Closer
+
+// Close closes every closer.
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// archiveTopLevel returns the distinct top-level names stored in an archive.
+func archiveTopLevel(archivePath string, enc *config.Encryption) ([]string, error) {
+	tr, closer, err := openArchive(archivePath, enc)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var names []string
+	seen := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive %s: %w", archivePath, err)
+		}
+		top := strings.SplitN(strings.TrimPrefix(hdr.Name, "./"), "/", 2)[0]
+		if top == manifestEntry || top == deletedEntry {
+			continue
+		}
+		if top != "" && !seen[top] {
+			seen[top] = true
+			names = append(names, top)
+		}
+	}
+}
+
+// extractArchive unpacks an archive into target, restoring modes, ownership
+// (when permitted), modification times, symlinks and hardlinks. Unless force is
+// set, it refuses to run when any top-level entry already exists in target.
+// Names listed in the deletion list of an incremental archive are removed.
+func extractArchive(archivePath, target string, force bool, enc *config.Encryption) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", target, err)
+	}
+
+	if !force {
+		names, err := archiveTopLevel(archivePath, enc)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := os.Lstat(filepath.Join(target, name)); err == nil {
+				return fmt.Errorf("%s already exists in %s (use --force to overwrite)", name, target)
+			}
+		}
+	}
+
+	tr, closer, err := openArchive(archivePath, enc)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	// Directory times are applied last, since extracting their contents changes them
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading archive %s: %w", archivePath, err)
+		}
+
+		switch hdr.Name {
+		case manifestEntry:
+			continue
+		case deletedEntry:
+			if err := applyDeletions(tr, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		dest, err := safeJoin(target, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := extractEntry(tr, hdr, target, dest); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{path: dest, mtime: hdr.ModTime})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nil
+}
+
+// applyDeletions removes the names read from a deletion list below target.
+func applyDeletions(r io.Reader, target string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading deletion list: %w", err)
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if name == "" {
+			continue
+		}
+		dest, err := safeJoin(target, name)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("failed to remove deleted entry %s: %w", dest, err)
+		}
+	}
+	return nil
+}
+
+// extractEntry writes one archive entry to dest.
+func extractEntry(tr io.Reader, hdr *tar.Header, target, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(dest), err)
+	}
+	// Replace whatever is in the way (only reachable with --force or inside
+	// fresh trees); directories only replace symlinks, so their mode and times
+	// are not applied to what a symlink points to
+	if info, err := os.Lstat(dest); err == nil && (hdr.Typeflag != tar.TypeDir || info.Mode()&fs.ModeSymlink != 0) {
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", dest, err)
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dest, err)
+		}
+
+	case tar.TypeReg:
+		out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", dest, err)
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("error extracting %s: %w", dest, err)
+		}
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, dest); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", dest, err)
+		}
+
+	case tar.TypeLink:
+		linkTarget, err := safeJoin(target, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(linkTarget, dest); err != nil {
+			return fmt.Errorf("failed to create hardlink %s: %w", dest, err)
+		}
+		return nil
+
+	default:
+		fmt.Printf("⚠️ Skipping unsupported entry %s (type %c)\n", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	// Ownership can only be restored by root; other users keep their own.
+	// It is set before the mode because chown clears setuid/setgid bits.
+	if err := os.Lchown(dest, hdr.Uid, hdr.Gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("failed to set owner of %s: %w", dest, err)
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	mode := hdr.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	if err := os.Chmod(dest, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", dest, err)
+	}
+	if err := os.Chtimes(dest, hdr.AccessTime, hdr.ModTime); err != nil {
+		return fmt.Errorf("failed to set times of %s: %w", dest, err)
+	}
+	return nil
+}
+
+// safeJoin resolves an archive entry name inside target, rejecting names
+// that would escape it, either with ".." or through a symlink below target
+// (such as one an earlier entry of the archive created).
+func safeJoin(target, name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("archive entry %q escapes the target directory", name)
+		}
+	}
+	clean := path.Clean("/" + name)
+	parent := target
+	for _, part := range strings.Split(path.Dir(clean), "/") {
+		if part == "" {
+			continue
+		}
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if err != nil {
+			// Missing directories are created by extractEntry
+			break
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %q leads through the symlink %s", name, parent)
+		}
+	}
+	return filepath.Join(target, filepath.FromSlash(clean)), nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+// Package backup
+package backup
+
+import "os"
+
+// fileID identifies a file by device and inode number.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkID reports no hardlinks on platforms without inode numbers.
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// inodeOf returns 0 on platforms without inode numbers.
+func inodeOf(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,184 @@
+// Package backup
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backup-tool/config"
+)
+
+func TestVerifyArchive(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	passphrase := &config.Encryption{Type: EncryptionPassphrase, Passphrase: config.Secret{Value: "secret"}}
+
+	tests := []struct {
+		name     string
+		opts     ArchiveOptions
+		mangle   func(data []byte) []byte
+		verifyAs *config.Encryption
+		wantErr  bool
+	}{
+		{name: "gzip", opts: ArchiveOptions{}},
+		{name: "zstd", opts: ArchiveOptions{Compression: &config.Compression{Type: CompressionZstd}}},
+		{name: "encrypted", opts: ArchiveOptions{Encryption: passphrase}, verifyAs: passphrase},
+		{name: "encrypted, wrong passphrase", opts: ArchiveOptions{Encryption: passphrase},
+			verifyAs: &config.Encryption{Type: EncryptionPassphrase, Passphrase: config.Secret{Value: "other"}}, wantErr: true},
+		{name: "truncated", opts: ArchiveOptions{}, mangle: func(data []byte) []byte { return data[:10] }, wantErr: true},
+		{name: "garbage", opts: ArchiveOptions{}, mangle: func(data []byte) []byte {
+			for i := range data {
+				data[i] ^= 0x5a
+			}
+			return data
+		}, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("dir%d_20260101_000000%s%s", i, compressionExt(tt.opts.Compression), encryptionSuffix(tt.opts.Encryption))
+			archive := filepath.Join(dir, name)
+			if err := runTar(archive, dir, "src", nil, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if tt.mangle != nil {
+				data, err := os.ReadFile(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(archive, tt.mangle(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := verifyArchive(archive, tt.verifyAs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyArchive = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testEntry is an entry of an archive written by writeTestArchive.
+type testEntry struct {
+	name     string
+	linkname string // makes the entry a symlink
+	content  string
+}
+
+// writeTestArchive writes a gzip-compressed tar archive with the given entries.
+func writeTestArchive(t *testing.T, archive string, entries []testEntry) {
+	t.Helper()
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		if e.linkname != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.linkname}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchiveEntryNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		want    string // file expected below the target, relative to it
+		wantErr bool
+	}{
+		{name: "nested path", entries: []testEntry{{name: "a/b/file", content: "data"}}, want: "a/b/file"},
+		{name: "parent directory", entries: []testEntry{{name: "../file", content: "data"}}, wantErr: true},
+		{name: "absolute name", entries: []testEntry{{name: "/outside/file", content: "data"}}, want: "outside/file"},
+		{name: "parent after subdirectory", entries: []testEntry{{name: "a/../../file", content: "data"}}, wantErr: true},
+		{name: "entry below symlink", entries: []testEntry{
+			{name: "link", linkname: "../outside"},
+			{name: "link/file", content: "data"},
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "target")
+			outside := filepath.Join(dir, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(dir, "dir_20260101_000000.tar.gz")
+			writeTestArchive(t, archive, tt.entries)
+
+			err := extractArchive(archive, target, false, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractArchive = %v, want error: %v", err, tt.wantErr)
+			}
+			for _, escaped := range []string{filepath.Join(dir, "file"), filepath.Join(outside, "file")} {
+				if _, err := os.Lstat(escaped); err == nil {
+					t.Errorf("%s was written outside the target", escaped)
+				}
+			}
+			if tt.want != "" {
+				data, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(tt.want)))
+				if err != nil || string(data) != "data" {
+					t.Errorf("%s = %q, %v, want %q", tt.want, data, err, "data")
+				}
+			}
+		})
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	target := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(target, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string // relative to target
+		wantErr bool
+	}{
+		{name: "a/b/file", want: "a/b/file"},
+		{name: "./a/file", want: "a/file"},
+		{name: "/abs/file", want: "abs/file"},
+		{name: "../file", wantErr: true},
+		{name: "a/../../file", wantErr: true},
+		{name: "a/../file", wantErr: true},
+		{name: "link/file", wantErr: true},
+		{name: "link", want: "link"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeJoin(target, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("safeJoin(%q) = %q, %v, want error: %v", tt.name, got, err, tt.wantErr)
+			}
+			if want := filepath.Join(target, filepath.FromSlash(tt.want)); !tt.wantErr && got != want {
+				t.Errorf("safeJoin(%q) = %q, want %q", tt.name, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+// Package backup
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID identifies a file by device and inode number.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkID returns the identity of a regular file that has more than one name.
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// inodeOf returns the inode number of a file, or 0 if unknown.
+func inodeOf(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
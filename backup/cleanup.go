@@ -2,36 +2,307 @@
 package backup
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"backup-tool/utils"
+	"backup-tool/config"
 )
 
-// cleanupOldBackups removes old backup files based on their lifetime.
-func cleanupOldBackups(dir, prefix string, lifetime int) {
+// cleanupOldBackups removes old backup files according to policy.
+// Archives that newer incremental or differential backups depend on are kept
+// until the archives depending on them expire as well. Only archives that can
+// be read (see verifyArchive, enc is the configured encryption) count for minKeep.
+func cleanupOldBackups(dir, prefix string, policy retentionPolicy, enc *config.Encryption, mode cleanupMode) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
 		fmt.Printf("⚠️ Failed to read %s: %v\n", dir, err)
 		return
 	}
 
+	var files []RemoteFile
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if info, err := entry.Info(); err == nil {
+			files = append(files, remoteFileFromInfo(info))
+		}
+	}
+	backups := datedBackups(files, prefix)
+
+	reasons, expired, protected := planCleanup(backups, policy, func(name string) string {
+		idx, err := readIndex(dir, name)
+		if err != nil {
+			return ""
+		}
+		return idx.Base
+	}, func(b datedBackup) bool {
+		if err := verifyArchive(filepath.Join(dir, b.Name), enc); err != nil {
+			fmt.Printf("⚠️ %s does not count for minKeep: %v\n", b.Name, err)
+			return false
+		}
+		return true
+	})
+	if mode.explain {
+		printPlan(dir, backups, reasons)
+	}
+
+	for _, b := range protected {
+		fmt.Printf("ℹ️ Keeping expired backup %s: newer backups depend on it\n", b.Name)
+	}
+
+	for _, b := range expired {
+		if mode.dryRun {
+			fmt.Printf("🗑️ Would delete old backup: %s\n", b.Name)
 			continue
 		}
-		name := entry.Name()
-		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".tar.gz") {
-			fullPath := filepath.Join(dir, name)
-			if utils.IsBackupOlderThan(fullPath, lifetime) {
-				if err := os.Remove(fullPath); err != nil {
-					fmt.Printf("❌ Failed to delete %s: %v\n", name, err)
-				} else {
-					fmt.Printf("🗑️ Deleted old backup: %s\n", name)
-				}
+		fullPath := filepath.Join(dir, b.Name)
+		if err := os.Remove(fullPath); err != nil {
+			fmt.Printf("❌ Failed to delete %s: %v\n", b.Name, err)
+		} else {
+			removeIndex(dir, b.Name)
+			fmt.Printf("🗑️ Deleted old backup: %s\n", b.Name)
+		}
+	}
+}
+
+// RemoteItem describes where the archives of one backup item are stored on
+// the destinations and how long they are kept there.
+type RemoteItem struct {
+	Dir    string // directory relative to the backup root, e.g. dirs/www
+	Prefix string // archive name prefix, e.g. dir_
+	// Snapshots is the repository snapshot directory of repository items,
+	// e.g. repository/snapshots/dirs/www
+	Snapshots string
+	Lifetime  int // days, used on destinations without a retention of their own
+	Keep      config.Keep
+	MinKeep   *int
+	// Retention overrides the lifetime on individual destinations (by name)
+	Retention map[string]int
+	// Failed is set if the item's backup failed in the run
+	Failed bool
+}
+
+// RemoteItems lists the backup items of cfg with their remote retention.
+// Items whose backup failed in the run recorded by summary are left out, so
+// their remote archives are not cleaned up while no new ones arrive.
+func RemoteItems(cfg *config.Config, summary *Summary) []RemoteItem {
+	var items []RemoteItem
+	for _, item := range configItems(cfg, summary) {
+		if item.Failed {
+			fmt.Printf("⚠️ Skipping remote cleanup of %s: its backup failed in this run\n", item.Dir)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// configItems lists the backup items of cfg, marking those whose backup
+// failed in the run recorded by summary.
+func configItems(cfg *config.Config, summary *Summary) []RemoteItem {
+	var items []RemoteItem
+	add := func(kind, source string, item RemoteItem) {
+		item.Failed = summary.failed(kind, source)
+		items = append(items, item)
+	}
+	for _, dir := range cfg.Dirs {
+		add("dir", dir.Path, RemoteItem{
+			Dir:       "dirs/" + dir.BackupName(),
+			Snapshots: repositorySnapshots("dirs", dir),
+			Prefix:    "dir_",
+			Lifetime:  dir.Lifetime,
+			Keep:      dir.Keep,
+			MinKeep:   dir.MinKeep,
+			Retention: dir.Retention,
+		})
+	}
+	for _, file := range cfg.Files {
+		add("file", file.Path, RemoteItem{
+			Dir:       "files/" + file.BackupName(),
+			Snapshots: repositorySnapshots("files", file),
+			Prefix:    "file_",
+			Lifetime:  file.Lifetime,
+			Keep:      file.Keep,
+			MinKeep:   file.MinKeep,
+			Retention: file.Retention,
+		})
+	}
+	for _, logItem := range cfg.Logs {
+		add("log", logItem.Path, RemoteItem{
+			Dir:       "logs/" + logItem.BackupName(),
+			Snapshots: repositorySnapshots("logs", logItem),
+			Prefix:    "log_",
+			Lifetime:  logItem.Lifetime,
+			Keep:      logItem.Keep,
+			MinKeep:   logItem.MinKeep,
+			Retention: logItem.Retention,
+		})
+	}
+	for _, db := range cfg.Databases {
+		add("db", db.Name, RemoteItem{
+			Dir:       "databases/" + db.Name,
+			Prefix:    "db_",
+			Lifetime:  db.Lifetime,
+			Keep:      db.Keep,
+			MinKeep:   db.MinKeep,
+			Retention: db.Retention,
+		})
+	}
+	return items
+}
+
+// repositorySnapshots returns the remote snapshot directory of item if it is
+// stored in the repository.
+func repositorySnapshots(category string, item config.Item) string {
+	if strings.ToLower(item.Storage) != StorageRepository {
+		return ""
+	}
+	return repositoryDirName + "/snapshots/" + category + "/" + item.BackupName()
+}
+
+// policyOn returns the retention of the item's archives on the destination:
+// the item's override for it, else the destination's lifetime and keep rules,
+// else the item's own. Without any of them archives are kept for one day.
+// The destination's minKeep takes precedence over the item's.
+func (item RemoteItem) policyOn(dest config.Destination) retentionPolicy {
+	policy := retentionPolicy{Lifetime: item.Lifetime, Keep: item.Keep}
+	if days, ok := item.Retention[dest.Name]; ok {
+		policy = retentionPolicy{Lifetime: days}
+	} else if dest.Lifetime > 0 || !dest.Keep.IsZero() {
+		policy = retentionPolicy{Lifetime: dest.Lifetime, Keep: dest.Keep}
+	}
+	if policy.Lifetime <= 0 && policy.Keep.IsZero() {
+		policy.Lifetime = 1
+	}
+	policy.MinKeep = minKeepOf(item.MinKeep)
+	if dest.MinKeep != nil {
+		policy.MinKeep = *dest.MinKeep
+	}
+	return policy
+}
+
+// CleanupDestination removes old backups on a destination according to the
+// retention of each item there. enc decrypts sealed repository snapshots. With
+// dryRun they are only listed.
+func CleanupDestination(cfg config.Destination, items []RemoteItem, enc *config.Encryption, dryRun bool) error {
+	return cleanupDestination(cfg, items, enc, cleanupMode{dryRun: dryRun})
+}
+
+// cleanupDestination opens the destination and applies the retention of items to it.
+func cleanupDestination(cfg config.Destination, items []RemoteItem, enc *config.Encryption, mode cleanupMode) error {
+	dest, err := OpenDestination(cfg)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	policies := make([]retentionPolicy, len(items))
+	for i, item := range items {
+		policies[i] = item.policyOn(cfg)
+	}
+	return cleanupRemote(dest, items, policies, enc, mode)
+}
+
+// cleanupRemote deletes the archives and repository snapshots of items[i] on
+// dest that policies[i] does not keep, and then the chunks no snapshot
+// references any more.
+func cleanupRemote(dest Destination, items []RemoteItem, policies []retentionPolicy, enc *config.Encryption, mode cleanupMode) error {
+	now := time.Now()
+	removedSnapshots := make(map[string]bool)
+
+	for i, item := range items {
+		remoteDir := item.Dir
+		if item.Snapshots != "" {
+			for _, p := range pruneRemoteSnapshots(dest, item.Snapshots, policies[i], mode) {
+				removedSnapshots[p] = true
 			}
 		}
+
+		// Read subdirectory contents on the destination
+		files, err := dest.List(remoteDir)
+		if err != nil {
+			fmt.Printf("⚠️ %v\n", err)
+			continue
+		}
+		if len(files) == 0 {
+			// Directory may not exist - this is normal, skip
+			fmt.Printf("ℹ️ Directory %s not found on %s (backups may not exist yet)\n", remoteDir, dest.Name())
+			continue
+		}
+
+		backups := datedBackups(files, item.Prefix)
+
+		// Uploads are checked (size, and SHA-256 with verify) before they get
+		// their final name; with checksums, an archive only counts for minKeep
+		// once its sidecar, written after the upload, is there as well
+		names := make(map[string]bool, len(files))
+		checksummed := false
+		for _, f := range files {
+			names[f.Name] = true
+			checksummed = checksummed || strings.HasSuffix(f.Name, checksumSuffix)
+		}
+		verify := func(b datedBackup) bool {
+			return !checksummed || names[b.Name+checksumSuffix]
+		}
+
+		// Keep bases of incremental chains that are still referenced (the
+		// snapshot indexes are mirrored together with the archives)
+		reasons, expired, protected := planCleanup(backups, policies[i], func(name string) string {
+			idx, err := readRemoteIndex(dest, remoteDir, name)
+			if err != nil {
+				return ""
+			}
+			return idx.Base
+		}, verify)
+		if mode.explain {
+			printPlan(remoteDir+" on "+dest.Name(), backups, reasons)
+		}
+
+		for _, b := range protected {
+			fmt.Printf("ℹ️ Keeping expired backup %s on %s: newer backups depend on it\n", remoteDir+"/"+b.Name, dest.Name())
+		}
+
+		deletedCount := 0
+		for _, b := range expired {
+			fullPath := remoteDir + "/" + b.Name
+			age := int(now.Sub(b.Time).Hours() / 24)
+			if mode.dryRun {
+				fmt.Printf("🗑️ Would delete old backup on %s: %s (age: %d days)\n", dest.Name(), fullPath, age)
+				continue
+			}
+			if err := dest.Delete(fullPath); err != nil {
+				fmt.Printf("⚠️ Failed to delete %s on %s: %v\n", fullPath, dest.Name(), err)
+			} else {
+				dest.Delete(remoteDir + "/" + indexDirName + "/" + b.Name + ".json")
+				dest.Delete(fullPath + checksumSuffix)
+				fmt.Printf("🗑️ Deleted old backup on %s: %s (age: %d days)\n", dest.Name(), fullPath, age)
+				deletedCount++
+			}
+		}
+
+		if deletedCount > 0 {
+			fmt.Printf("✅ Cleaned up %d old backups in %s on %s\n", deletedCount, remoteDir, dest.Name())
+		}
+	}
+
+	if len(removedSnapshots) > 0 {
+		return collectRemoteGarbage(dest, removedSnapshots, enc, mode)
+	}
+	return nil
+}
+
+// readRemoteIndex reads the snapshot index of an archive from a destination.
+func readRemoteIndex(dest Destination, remoteDir, archiveName string) (*snapshotIndex, error) {
+	r, err := dest.Get(remoteDir + "/" + indexDirName + "/" + archiveName + ".json")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var idx snapshotIndex
+	if err := json.NewDecoder(r).Decode(&idx); err != nil {
+		return nil, err
 	}
+	return &idx, nil
 }
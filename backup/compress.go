@@ -0,0 +1,134 @@
+// Package backup
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"backup-tool/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression types.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionXz   = "xz"
+	CompressionNone = "none"
+)
+
+// Magic bytes used to detect the compression of an archive when reading it.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// xzDictSizes maps xz presets 0-9 to their dictionary size, as in xz(1).
+var xzDictSizes = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// compressionType returns the normalized compression type; gzip if unset.
+func compressionType(c *config.Compression) string {
+	if c == nil || c.Type == "" {
+		return CompressionGzip
+	}
+	return strings.ToLower(c.Type)
+}
+
+// compressionExt returns the archive extension for c, e.g. ".tar.zst".
+func compressionExt(c *config.Compression) string {
+	switch compressionType(c) {
+	case CompressionZstd:
+		return ".tar.zst"
+	case CompressionXz:
+		return ".tar.xz"
+	case CompressionNone:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+// compressWriter wraps w so that everything written is compressed according to
+// c (gzip with the default level if c is nil). Close must be called to flush
+// the stream; it does not close w.
+func compressWriter(w io.Writer, c *config.Compression) (io.WriteCloser, error) {
+	var level *int
+	threads := 0
+	if c != nil {
+		level, threads = c.Level, c.Threads
+	}
+
+	switch compressionType(c) {
+	case CompressionGzip:
+		gzipLevel := pgzip.DefaultCompression
+		if level != nil {
+			gzipLevel = *level
+		}
+		gz, err := pgzip.NewWriterLevel(w, gzipLevel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip level %d: %w", gzipLevel, err)
+		}
+		if threads > 0 {
+			if err := gz.SetConcurrency(1<<20, threads); err != nil {
+				return nil, fmt.Errorf("invalid gzip thread count %d: %w", threads, err)
+			}
+		}
+		return gz, nil
+
+	case CompressionZstd:
+		opts := []zstd.EOption{}
+		if level != nil {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(*level)))
+		}
+		if threads > 0 {
+			opts = append(opts, zstd.WithEncoderConcurrency(threads))
+		}
+		return zstd.NewWriter(w, opts...)
+
+	case CompressionXz:
+		cfg := xz.WriterConfig{}
+		if level != nil {
+			if *level < 0 || *level >= len(xzDictSizes) {
+				return nil, fmt.Errorf("invalid xz level %d (expected 0-9)", *level)
+			}
+			cfg.DictCap = xzDictSizes[*level]
+		}
+		return cfg.NewWriter(w)
+
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression type: %s", c.Type)
+}
+
+// decompressReader returns a reader for the uncompressed content of r. The
+// compression is detected from the content, so archives written with any
+// supported setting can be read regardless of the current configuration.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(xzMagic))
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return pgzip.NewReader(br)
+	case bytes.HasPrefix(head, zstdMagic):
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case bytes.HasPrefix(head, xzMagic):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	}
+	return io.NopCloser(br), nil
+}
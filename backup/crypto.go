@@ -0,0 +1,350 @@
+// Package backup
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"backup-tool/config"
+	"filippo.io/age"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encryption types.
+const (
+	EncryptionAge        = "age"
+	EncryptionPassphrase = "passphrase"
+)
+
+// Passphrase-encrypted files (".enc") use AES-256-GCM in fixed-size segments
+// (the STREAM construction), so they can be written and read as a stream:
+//
+//	magic (8) | scrypt salt (16) | nonce prefix (7) | segment...
+//
+// Every segment is sealed with the nonce prefix, a big-endian segment counter
+// and a flag byte that is 1 for the last segment, which detects truncation.
+const (
+	encMagic       = "BTENC001"
+	encSaltSize    = 16
+	encPrefixSize  = 7
+	encSegmentSize = 64 << 10
+)
+
+// ageMagic starts every age-encrypted file.
+const ageMagic = "age-encryption.org/"
+
+// chunkIDSalt separates the chunk id key from the keys a passphrase encrypts
+// with, which use random salts.
+const chunkIDSalt = "backup-tool chunk ids"
+
+// encryptionSuffix returns the extension appended to encrypted archive names.
+func encryptionSuffix(enc *config.Encryption) string {
+	if enc == nil {
+		return ""
+	}
+	switch strings.ToLower(enc.Type) {
+	case EncryptionAge:
+		return ".age"
+	case EncryptionPassphrase:
+		return ".enc"
+	}
+	return ""
+}
+
+// encryptWriter wraps w so that everything written is encrypted according to
+// enc. With no encryption configured, data is passed through unchanged.
+// Close must be called to finish the stream; it does not close w.
+func encryptWriter(w io.Writer, enc *config.Encryption) (io.WriteCloser, error) {
+	if enc == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	switch strings.ToLower(enc.Type) {
+	case EncryptionAge:
+		recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(enc.Recipients, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipients: %w", err)
+		}
+		return age.Encrypt(w, recipients...)
+
+	case EncryptionPassphrase:
+		if enc.Passphrase.Value == "" {
+			return nil, fmt.Errorf("encryption passphrase is empty")
+		}
+		salt, key, err := writeKey(enc.Passphrase.Value)
+		if err != nil {
+			return nil, err
+		}
+		prefix := make([]byte, encPrefixSize)
+		if _, err := rand.Read(prefix); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		header := append(append([]byte(encMagic), salt...), prefix...)
+		if _, err := w.Write(header); err != nil {
+			return nil, err
+		}
+		return &segmentWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encSegmentSize)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported encryption type: %s", enc.Type)
+}
+
+// decryptReader returns a reader for the plaintext of r. The format is detected
+// from the content, so unencrypted data is passed through and age or passphrase
+// encrypted data is decrypted with the keys from enc.
+func decryptReader(r io.Reader, enc *config.Encryption) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(ageMagic))
+
+	switch {
+	case bytes.HasPrefix(head, []byte(ageMagic)):
+		if enc == nil || enc.IdentityFile == "" {
+			return nil, fmt.Errorf("data is age-encrypted but no encryption.identityFile is configured")
+		}
+		identityData, err := os.ReadFile(enc.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read age identity file: %w", err)
+		}
+		identities, err := age.ParseIdentities(bytes.NewReader(identityData))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age identity file %s: %w", enc.IdentityFile, err)
+		}
+		return age.Decrypt(br, identities...)
+
+	case bytes.HasPrefix(head, []byte(encMagic)):
+		if enc == nil || enc.Passphrase.Value == "" {
+			return nil, fmt.Errorf("data is passphrase-encrypted but no encryption.passphrase is configured")
+		}
+		header := make([]byte, len(encMagic)+encSaltSize+encPrefixSize)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, fmt.Errorf("truncated encryption header: %w", err)
+		}
+		salt := header[len(encMagic) : len(encMagic)+encSaltSize]
+		key, err := deriveKey(enc.Passphrase.Value, salt)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		return &segmentReader{r: br, aead: aead, prefix: header[len(encMagic)+encSaltSize:]}, nil
+	}
+
+	return br, nil
+}
+
+// chunkIDKey returns the secret repository chunk ids are derived from with
+// encryption, so that chunk names on destinations do not give away the SHA-256
+// of their content. It is derived from the passphrase, or for age from the
+// identity file, or the recipients if none is configured.
+func chunkIDKey(enc *config.Encryption) ([]byte, error) {
+	switch strings.ToLower(enc.Type) {
+	case EncryptionPassphrase:
+		if enc.Passphrase.Value == "" {
+			return nil, fmt.Errorf("encryption passphrase is empty")
+		}
+		return deriveKey(enc.Passphrase.Value, []byte(chunkIDSalt))
+
+	case EncryptionAge:
+		secret := strings.Join(enc.Recipients, "\n")
+		if enc.IdentityFile != "" {
+			identityData, err := os.ReadFile(enc.IdentityFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read age identity file: %w", err)
+			}
+			secret = string(identityData)
+		}
+		sum := sha256.Sum256([]byte(chunkIDSalt + "\x00" + secret))
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("unsupported encryption type: %s", enc.Type)
+}
+
+// keyCache avoids running scrypt for every file of a run: writers share one
+// salt per process, and readers cache keys by salt.
+var keyCache struct {
+	sync.Mutex
+	writeSalt []byte
+	keys      map[string][]byte
+}
+
+// writeKey returns the salt and key used for encrypting in this process.
+func writeKey(passphrase string) ([]byte, []byte, error) {
+	keyCache.Lock()
+	if keyCache.writeSalt == nil {
+		salt := make([]byte, encSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			keyCache.Unlock()
+			return nil, nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		keyCache.writeSalt = salt
+	}
+	salt := keyCache.writeSalt
+	keyCache.Unlock()
+
+	key, err := deriveKey(passphrase, salt)
+	return salt, key, err
+}
+
+// deriveKey derives the AES-256 key for a passphrase and salt.
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+
+	id := passphrase + "\x00" + string(salt)
+	if key, ok := keyCache.keys[id]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+	if keyCache.keys == nil {
+		keyCache.keys = make(map[string][]byte)
+	}
+	keyCache.keys[id] = key
+	return key, nil
+}
+
+// newGCM returns AES-256-GCM for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AES: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce builds the nonce of segment n.
+func segmentNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// segmentWriter encrypts data in segments of encSegmentSize bytes.
+type segmentWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	n      uint32
+}
+
+// Write buffers p and seals every completed segment.
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so that the
+		// final segment is always sealed with the last flag by Close
+		if len(s.buf) == encSegmentSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):encSegmentSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush seals and writes the buffered segment.
+func (s *segmentWriter) flush(last bool) error {
+	if s.n == ^uint32(0) {
+		return errors.New("encrypted stream too long")
+	}
+	sealed := s.aead.Seal(nil, segmentNonce(s.prefix, s.n, last), s.buf, nil)
+	s.n++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close seals the final segment.
+func (s *segmentWriter) Close() error {
+	return s.flush(true)
+}
+
+// segmentReader decrypts a stream written by segmentWriter.
+type segmentReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	plain  []byte
+	done   bool
+}
+
+// Read returns plaintext, opening segments as needed.
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next segment.
+func (s *segmentReader) next() error {
+	sealed := make([]byte, encSegmentSize+s.aead.Overhead())
+	n, err := io.ReadFull(s.r, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return fmt.Errorf("encrypted stream is truncated")
+		}
+		return err
+	}
+	sealed = sealed[:n]
+
+	// A full-size segment may or may not be the last one
+	if n == encSegmentSize+s.aead.Overhead() {
+		if plain, err := s.aead.Open(nil, segmentNonce(s.prefix, s.n, false), sealed, nil); err == nil {
+			s.plain = plain
+			s.n++
+			return nil
+		}
+	}
+	plain, err := s.aead.Open(nil, segmentNonce(s.prefix, s.n, true), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("decryption failed (wrong passphrase or corrupted data)")
+	}
+	s.plain = plain
+	s.done = true
+	return nil
+}
+
+// nopWriteCloser adds a no-op Close to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing.
+func (nopWriteCloser) Close() error { return nil }
@@ -2,96 +2,144 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"backup-tool/config"
 )
 
-// BackupDatabases creates backups of databases and archives them into tar.gz files.
-func BackupDatabases(localPath string, dbs []config.Database, users map[string]config.DBUser) error {
+// dumpTools maps the supported database types to their dump command.
+var dumpTools = map[string]string{
+	"postgres": "pg_dump",
+	"mysql":    "mysqldump",
+	"mongo":    "mongodump",
+}
+
+// BackupDatabases creates backups of databases and archives them into compressed tar files.
+func BackupDatabases(localPath string, dbs []config.Database, users map[string]config.DBUser, opts ArchiveOptions, summary *Summary) error {
+	var errs []error
 	for _, db := range dbs {
-		user, exists := users[db.UserRef]
-		if !exists {
-			return fmt.Errorf("databaseUsers.%s not found for database %s", db.UserRef, db.Name)
+		result := backupDatabase(localPath, db, users, opts.withCompression(db.Compression))
+		summary.add(result)
+		if result.Err != nil {
+			errs = append(errs, result.Err)
 		}
+	}
+	return errors.Join(errs...)
+}
 
-		subDir, err := ensureBackupSubdir(localPath, "databases", db.Name)
-		if err != nil {
-			return fmt.Errorf("failed to create subdirectory for database %s: %w", db.Name, err)
-		}
+// backupDatabase dumps and archives a single database.
+func backupDatabase(localPath string, db config.Database, users map[string]config.DBUser, opts ArchiveOptions) ItemResult {
+	result := ItemResult{Kind: "db", Source: db.Name}
 
-		archiveName := fmt.Sprintf("db_%s.tar.gz", time.Now().Format("20060102_150405"))
-		archivePath := filepath.Join(subDir, archiveName)
+	user, exists := users[db.UserRef]
+	if !exists {
+		result.Err = fmt.Errorf("databaseUsers.%s not found for database %s", db.UserRef, db.Name)
+		return result
+	}
 
-		tempDir, err := os.MkdirTemp("", "dbbackup-*")
-		if err != nil {
-			return fmt.Errorf("failed to create temporary directory: %w", err)
+	if opts.DryRun {
+		tool, ok := dumpTools[strings.ToLower(db.Type)]
+		if !ok {
+			result.Err = fmt.Errorf("unsupported database type: %s", db.Type)
+			return result
 		}
-		defer os.RemoveAll(tempDir)
-
-		switch strings.ToLower(db.Type) {
-		case "postgres":
-			tarFile := filepath.Join(tempDir, "dump.tar")
-			cmd := exec.Command("pg_dump", "-h", user.Host, "-p", fmt.Sprint(user.Port), "-U", user.User, "-F", "t", "-f", tarFile, db.Name)
-			cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%s", user.Password))
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("pg_dump error for %s: %w", db.Name, err)
-			}
-			if err := runTar(archivePath, tempDir, "dump.tar"); err != nil {
-				return fmt.Errorf("error archiving PostgreSQL backup: %w", err)
-			}
+		if _, err := exec.LookPath(tool); err != nil {
+			result.Err = fmt.Errorf("%s not found for database %s: %w", tool, db.Name, err)
+			return result
+		}
+		fmt.Printf("🔍 Would dump %s database %s as %s@%s:%d with %s\n", db.Type, db.Name, user.User, user.Host, user.Port, tool)
+		result.Archive = planArchive(localPath, "databases", db.Name, "db_", db.Name, databasePolicy(db), opts)
+		result.Planned = true
+		return result
+	}
 
-		case "mysql":
-			sqlFile := filepath.Join(tempDir, "dump.sql")
-			cmd := exec.Command("mysqldump",
-				"-h", user.Host,
-				"-P", fmt.Sprint(user.Port),
-				"-u", user.User,
-				"--password="+user.Password,
-				db.Name,
-				"--result-file", sqlFile)
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("mysqldump error for %s: %w", db.Name, err)
-			}
-			if err := runTar(archivePath, tempDir, "dump.sql"); err != nil {
-				return fmt.Errorf("error archiving MySQL backup: %w", err)
-			}
+	subDir, err := ensureBackupSubdir(localPath, "databases", db.Name)
+	if err != nil {
+		result.Err = fmt.Errorf("failed to create subdirectory for database %s: %w", db.Name, err)
+		return result
+	}
 
-		case "mongo":
-			dumpDir := filepath.Join(tempDir, "dump")
-			cmd := exec.Command("mongodump",
-				"--host", fmt.Sprintf("%s:%d", user.Host, user.Port),
-				"--db", db.Name,
-				"--out", dumpDir)
-			if user.User != "" {
-				cmd.Args = append(cmd.Args, "--username", user.User)
-				if user.Password != "" {
-					cmd.Args = append(cmd.Args, "--password", user.Password)
-				}
-			}
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("mongodump error for %s: %w", db.Name, err)
-			}
-			if err := runTar(archivePath, tempDir, "dump"); err != nil {
-				return fmt.Errorf("error archiving MongoDB backup: %w", err)
-			}
+	archiveName := archiveFileName("db_", opts)
+	archivePath := filepath.Join(subDir, archiveName)
+
+	tempDir, err := os.MkdirTemp("", "dbbackup-*")
+	if err != nil {
+		result.Err = fmt.Errorf("failed to create temporary directory: %w", err)
+		return result
+	}
+	defer os.RemoveAll(tempDir)
+
+	switch strings.ToLower(db.Type) {
+	case "postgres":
+		tarFile := filepath.Join(tempDir, "dump.tar")
+		cmd := exec.Command("pg_dump", "-h", user.Host, "-p", fmt.Sprint(user.Port), "-U", user.User, "-F", "t", "-f", tarFile, db.Name)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%s", user.Password.Value))
+		if err := cmd.Run(); err != nil {
+			result.Err = fmt.Errorf("pg_dump error for %s: %w", db.Name, err)
+			return result
+		}
+		if err := runTar(archivePath, tempDir, "dump.tar", nil, opts); err != nil {
+			result.Err = fmt.Errorf("error archiving PostgreSQL backup: %w", err)
+			return result
+		}
 
-		default:
-			return fmt.Errorf("unsupported database type: %s", db.Type)
+	case "mysql":
+		sqlFile := filepath.Join(tempDir, "dump.sql")
+		cmd := exec.Command("mysqldump",
+			"-h", user.Host,
+			"-P", fmt.Sprint(user.Port),
+			"-u", user.User,
+			"--password="+user.Password.Value,
+			db.Name,
+			"--result-file", sqlFile)
+		if err := cmd.Run(); err != nil {
+			result.Err = fmt.Errorf("mysqldump error for %s: %w", db.Name, err)
+			return result
+		}
+		if err := runTar(archivePath, tempDir, "dump.sql", nil, opts); err != nil {
+			result.Err = fmt.Errorf("error archiving MySQL backup: %w", err)
+			return result
 		}
 
-		// Verify that archive was actually created
-		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
-			return fmt.Errorf("archive was not created: %s", archivePath)
+	case "mongo":
+		dumpDir := filepath.Join(tempDir, "dump")
+		cmd := exec.Command("mongodump",
+			"--host", fmt.Sprintf("%s:%d", user.Host, user.Port),
+			"--db", db.Name,
+			"--out", dumpDir)
+		if user.User != "" {
+			cmd.Args = append(cmd.Args, "--username", user.User)
+			if user.Password.Value != "" {
+				cmd.Args = append(cmd.Args, "--password", user.Password.Value)
+			}
+		}
+		if err := cmd.Run(); err != nil {
+			result.Err = fmt.Errorf("mongodump error for %s: %w", db.Name, err)
+			return result
+		}
+		if err := runTar(archivePath, tempDir, "dump", nil, opts); err != nil {
+			result.Err = fmt.Errorf("error archiving MongoDB backup: %w", err)
+			return result
 		}
 
-		fmt.Printf("✅ Database backup %s → %s\n", db.Name, archivePath)
-		cleanupOldBackups(subDir, "db_", db.Lifetime)
+	default:
+		result.Err = fmt.Errorf("unsupported database type: %s", db.Type)
+		return result
 	}
-	return nil
+
+	// Verify that archive was actually created
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		result.Err = fmt.Errorf("archive was not created: %s", archivePath)
+		return result
+	}
+
+	result.Archive = archivePath
+	fmt.Printf("✅ Database backup %s → %s\n", db.Name, archivePath)
+	cleanupOldBackups(subDir, "db_", databasePolicy(db), opts.Encryption, cleanupMode{})
+	return result
 }
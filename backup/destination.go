@@ -0,0 +1,107 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+)
+
+// Destination types.
+const (
+	DestinationSMB    = "smb"
+	DestinationS3     = "s3"
+	DestinationSFTP   = "sftp"
+	DestinationWebDAV = "webdav"
+	DestinationLocal  = "local"
+)
+
+// RemoteFile describes an entry on a destination.
+type RemoteFile struct {
+	Name    string // base name
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Destination is a remote store the backup tree is mirrored to. Paths are
+// relative to the root of the destination and always use "/" as separator.
+type Destination interface {
+	// Name identifies the destination in logs and restore output.
+	Name() string
+	// Put stores size bytes read from r at rel, creating parent directories as
+	// needed. The file must only become visible under rel once it is complete.
+	Put(rel string, r io.Reader, size int64) error
+	// List returns the entries of directory rel. A missing directory is not an
+	// error and yields no entries.
+	List(rel string) ([]RemoteFile, error)
+	// Stat returns information about rel; the error satisfies os.IsNotExist
+	// (an *os.PathError wrapping os.ErrNotExist) if it does not exist.
+	Stat(rel string) (RemoteFile, error)
+	// Delete removes the file rel.
+	Delete(rel string) error
+	// Move renames the file from to to, which must not exist, creating parent
+	// directories as needed.
+	Move(from, to string) error
+	// Get opens the file rel for reading.
+	Get(rel string) (io.ReadCloser, error)
+	// Close releases the connection.
+	Close() error
+}
+
+// OpenDestination connects to the destination described by cfg.
+func OpenDestination(cfg config.Destination) (Destination, error) {
+	switch strings.ToLower(cfg.Type) {
+	case DestinationSMB:
+		if cfg.SMB == nil {
+			return nil, fmt.Errorf("destination %s: missing smb settings", cfg.Name)
+		}
+		return openSMBDestination(cfg.Name, *cfg.SMB, cfg.Verify)
+	case DestinationS3:
+		if cfg.S3 == nil {
+			return nil, fmt.Errorf("destination %s: missing s3 settings", cfg.Name)
+		}
+		return openS3Destination(cfg.Name, *cfg.S3, cfg.Verify)
+	case DestinationSFTP:
+		if cfg.SFTP == nil {
+			return nil, fmt.Errorf("destination %s: missing sftp settings", cfg.Name)
+		}
+		return openSFTPDestination(cfg.Name, *cfg.SFTP, cfg.Verify)
+	case DestinationWebDAV:
+		if cfg.WebDAV == nil {
+			return nil, fmt.Errorf("destination %s: missing webdav settings", cfg.Name)
+		}
+		return openWebDAVDestination(cfg.Name, *cfg.WebDAV, cfg.Verify)
+	case DestinationLocal:
+		if cfg.Local == nil {
+			return nil, fmt.Errorf("destination %s: missing local settings", cfg.Name)
+		}
+		return openLocalDestination(cfg.Name, *cfg.Local, cfg.Verify)
+	}
+	return nil, fmt.Errorf("destination %s: unsupported type %q", cfg.Name, cfg.Type)
+}
+
+// resumingDestination is implemented by destinations whose Put continues an
+// interrupted upload from its .partial file when r is an io.Seeker, so such
+// files must not be removed before the upload is retried.
+type resumingDestination interface {
+	Destination
+	resumesUploads()
+}
+
+// partialName returns the temporary name a file is uploaded under by
+// destinations that cannot write atomically, e.g.
+// dirs/www/.dir_20240101_120000.tar.gz.partial.
+func partialName(rel string) string {
+	dir, name := path.Split(rel)
+	return dir + "." + name + partialSuffix
+}
+
+// isPartialName reports whether name is a temporary upload name.
+func isPartialName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, partialSuffix)
+}
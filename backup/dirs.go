@@ -2,52 +2,128 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
 	"backup-tool/config"
 )
 
-// BackupDirs archives directories into tar.gz archives.
-// Creates structure: <localBackupPath>/dirs/<basename>/dir_YYYYMMDD_HHMMSS.tar.gz
-func BackupDirs(localPath string, items []config.Item) error {
+// BackupDirs archives directories into compressed tar archives.
+// Creates structure: <localBackupPath>/dirs/<name>/dir_YYYYMMDD_HHMMSS.tar.gz (extension follows the compression)
+// Entries matching the item's exclude patterns (or .backupignore files in the tree)
+// are left out; if include patterns are given, only matching entries are archived.
+func BackupDirs(localPath string, items []config.Item, opts ArchiveOptions, summary *Summary) error {
+	var errs []error
 	for _, item := range items {
-		srcPath := item.Path
-		info, err := os.Stat(srcPath)
-		if os.IsNotExist(err) {
-			fmt.Printf("⚠️ Directory %s does not exist — skipping\n", srcPath)
-			continue
+		result := backupDir(localPath, item, opts.withCompression(item.Compression))
+		summary.add(result)
+		if result.Err != nil {
+			errs = append(errs, result.Err)
 		}
-		if err != nil {
-			return fmt.Errorf("error checking directory %s: %w", srcPath, err)
-		}
-		if !info.IsDir() {
-			return fmt.Errorf("%s is not a directory", srcPath)
+	}
+	return errors.Join(errs...)
+}
+
+// backupDir archives a single directory item.
+func backupDir(localPath string, item config.Item, opts ArchiveOptions) ItemResult {
+	srcPath := item.Path
+	result := ItemResult{Kind: "dir", Source: srcPath}
+
+	info, err := os.Stat(srcPath)
+	if os.IsNotExist(err) {
+		fmt.Printf("⚠️ Directory %s does not exist — skipping\n", srcPath)
+		result.Skipped = true
+		return result
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("error checking directory %s: %w", srcPath, err)
+		return result
+	}
+	if !info.IsDir() {
+		result.Err = fmt.Errorf("%s is not a directory", srcPath)
+		return result
+	}
+
+	baseName := filepath.Base(srcPath)
+	name := item.BackupName()
+	parentDir := filepath.Dir(srcPath)
+	filter := newPathFilter(srcPath, item.Exclude, item.Include)
+
+	if opts.DryRun {
+		if strings.ToLower(item.Storage) == StorageRepository {
+			result.Archive = planRepositorySnapshot(localPath, "dirs", name, srcPath, itemPolicy(item), opts)
+		} else {
+			result.Archive = planArchive(localPath, "dirs", name, "dir_", srcPath, itemPolicy(item), opts)
 		}
+		result.Planned = true
+		result.Patterns = describePatterns(item.Exclude, item.Include)
+		return result
+	}
 
-		baseName := filepath.Base(srcPath)
-		subDir, err := ensureBackupSubdir(localPath, "dirs", baseName)
+	if strings.ToLower(item.Storage) == StorageRepository {
+		snapPath, err := backupToRepository(localPath, "dirs", name, "dir_", parentDir, baseName, itemPolicy(item), filter, opts)
 		if err != nil {
-			return fmt.Errorf("failed to create subdirectory for %s: %w", baseName, err)
+			result.Err = fmt.Errorf("error storing directory %s in repository: %w", srcPath, err)
+			return result
 		}
+		result.Archive = snapPath
+		result.Excluded = filter.Excluded
+		result.Patterns = describePatterns(item.Exclude, item.Include)
+		fmt.Printf("✅ Directory %s → %s\n", srcPath, snapPath)
+		return result
+	}
 
-		archiveName := fmt.Sprintf("dir_%s.tar.gz", time.Now().Format("20060102_150405"))
-		archivePath := filepath.Join(subDir, archiveName)
+	subDir, err := ensureBackupSubdir(localPath, "dirs", name)
+	if err != nil {
+		result.Err = fmt.Errorf("failed to create subdirectory for %s: %w", name, err)
+		return result
+	}
 
-		parentDir := filepath.Dir(srcPath)
-		if err := runTar(archivePath, parentDir, baseName); err != nil {
-			return fmt.Errorf("error archiving directory %s: %w", srcPath, err)
-		}
+	archiveName := archiveFileName("dir_", opts)
+	archivePath := filepath.Join(subDir, archiveName)
 
-		// Verify that archive was actually created
-		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
-			return fmt.Errorf("archive was not created: %s", archivePath)
-		}
+	var manifest *archiveManifest
+	switch strings.ToLower(item.Mode) {
+	case ModeIncremental, ModeDifferential:
+		manifest, err = runSnapshotTar(archivePath, subDir, parentDir, baseName, item, filter, opts)
+	default:
+		err = runTar(archivePath, parentDir, baseName, filter, opts)
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("error archiving directory %s: %w", srcPath, err)
+		return result
+	}
 
+	// Verify that archive was actually created
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		result.Err = fmt.Errorf("archive was not created: %s", archivePath)
+		return result
+	}
+
+	result.Archive = archivePath
+	result.Excluded = filter.Excluded
+	result.Patterns = describePatterns(item.Exclude, item.Include)
+	if filter.Excluded > 0 && result.Patterns == "" {
+		result.Patterns = ignoreFileName
+	}
+
+	var notes []string
+	if manifest != nil && manifest.Base != "" {
+		notes = append(notes, fmt.Sprintf("%s against %s", manifest.Type, manifest.Base))
+	} else if manifest != nil {
+		notes = append(notes, manifest.Type)
+	}
+	if filter.Excluded > 0 {
+		notes = append(notes, fmt.Sprintf("%d entries skipped", filter.Excluded))
+	}
+	if len(notes) > 0 {
+		fmt.Printf("✅ Directory %s → %s (%s)\n", srcPath, archivePath, strings.Join(notes, ", "))
+	} else {
 		fmt.Printf("✅ Directory %s → %s\n", srcPath, archivePath)
-		cleanupOldBackups(subDir, "dir_", item.Lifetime)
 	}
-	return nil
+	cleanupOldBackups(subDir, "dir_", itemPolicy(item), opts.Encryption, cleanupMode{})
+	return result
 }
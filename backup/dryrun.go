@@ -0,0 +1,30 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// planArchive reports, for a dry run, the archive that would be written for an
+// item and the local backups its retention would delete. Nothing is created.
+func planArchive(localPath, category, name, prefix, source string, policy retentionPolicy, opts ArchiveOptions) string {
+	subDir := filepath.Join(localPath, category, name)
+	archivePath := filepath.Join(subDir, archiveFileName(prefix, opts))
+	fmt.Printf("🔍 Would archive %s → %s\n", source, archivePath)
+	if _, err := os.Stat(subDir); err == nil {
+		cleanupOldBackups(subDir, prefix, policy, opts.Encryption, cleanupMode{dryRun: true})
+	}
+	return archivePath
+}
+
+// planRepositorySnapshot reports, for a dry run, the repository snapshot that
+// would be taken for an item and the snapshots its retention would remove.
+func planRepositorySnapshot(localPath, category, name, source string, policy retentionPolicy, opts ArchiveOptions) string {
+	repo := &repository{root: filepath.Join(localPath, repositoryDirName), enc: opts.Encryption}
+	snapDir := repo.snapshotDir(category, name)
+	fmt.Printf("🔍 Would store %s in repository %s\n", source, snapDir)
+	repo.pruneSnapshots(category, name, policy, "", cleanupMode{dryRun: true})
+	return snapDir
+}
@@ -2,52 +2,96 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
 	"backup-tool/config"
 )
 
-// BackupFiles archives individual files into tar.gz archives.
-// Creates structure: <localBackupPath>/files/<basename>/file_YYYYMMDD_HHMMSS.tar.gz
-func BackupFiles(localPath string, items []config.Item) error {
+// BackupFiles archives individual files into compressed tar archives.
+// Creates structure: <localBackupPath>/files/<name>/file_YYYYMMDD_HHMMSS.tar.gz (extension follows the compression)
+func BackupFiles(localPath string, items []config.Item, opts ArchiveOptions, summary *Summary) error {
+	var errs []error
 	for _, item := range items {
-		srcPath := item.Path
-		info, err := os.Stat(srcPath)
-		if os.IsNotExist(err) {
-			fmt.Printf("⚠️ File %s does not exist — skipping\n", srcPath)
-			continue
+		result := backupFile(localPath, item, opts.withCompression(item.Compression))
+		summary.add(result)
+		if result.Err != nil {
+			errs = append(errs, result.Err)
 		}
-		if err != nil {
-			return fmt.Errorf("error checking file %s: %w", srcPath, err)
-		}
-		if info.IsDir() {
-			return fmt.Errorf("%s is a directory, use BackupDirs instead", srcPath)
+	}
+	return errors.Join(errs...)
+}
+
+// backupFile archives a single file item.
+func backupFile(localPath string, item config.Item, opts ArchiveOptions) ItemResult {
+	srcPath := item.Path
+	result := ItemResult{Kind: "file", Source: srcPath}
+
+	info, err := os.Stat(srcPath)
+	if os.IsNotExist(err) {
+		fmt.Printf("⚠️ File %s does not exist — skipping\n", srcPath)
+		result.Skipped = true
+		return result
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("error checking file %s: %w", srcPath, err)
+		return result
+	}
+	if info.IsDir() {
+		result.Err = fmt.Errorf("%s is a directory, use BackupDirs instead", srcPath)
+		return result
+	}
+
+	baseName := filepath.Base(srcPath)
+	name := item.BackupName()
+	parentDir := filepath.Dir(srcPath)
+
+	if opts.DryRun {
+		if strings.ToLower(item.Storage) == StorageRepository {
+			result.Archive = planRepositorySnapshot(localPath, "files", name, srcPath, itemPolicy(item), opts)
+		} else {
+			result.Archive = planArchive(localPath, "files", name, "file_", srcPath, itemPolicy(item), opts)
 		}
+		result.Planned = true
+		return result
+	}
 
-		baseName := filepath.Base(srcPath)
-		subDir, err := ensureBackupSubdir(localPath, "files", baseName)
+	if strings.ToLower(item.Storage) == StorageRepository {
+		snapPath, err := backupToRepository(localPath, "files", name, "file_", parentDir, baseName, itemPolicy(item), nil, opts)
 		if err != nil {
-			return fmt.Errorf("failed to create subdirectory for file %s: %w", baseName, err)
+			result.Err = fmt.Errorf("error storing file %s in repository: %w", srcPath, err)
+			return result
 		}
+		result.Archive = snapPath
+		fmt.Printf("✅ File %s → %s\n", srcPath, snapPath)
+		return result
+	}
 
-		archiveName := fmt.Sprintf("file_%s.tar.gz", time.Now().Format("20060102_150405"))
-		archivePath := filepath.Join(subDir, archiveName)
+	subDir, err := ensureBackupSubdir(localPath, "files", name)
+	if err != nil {
+		result.Err = fmt.Errorf("failed to create subdirectory for file %s: %w", name, err)
+		return result
+	}
 
-		parentDir := filepath.Dir(srcPath)
-		if err := runTar(archivePath, parentDir, baseName); err != nil {
-			return fmt.Errorf("error archiving file %s: %w", srcPath, err)
-		}
+	archiveName := archiveFileName("file_", opts)
+	archivePath := filepath.Join(subDir, archiveName)
 
-		// Verify that archive was actually created
-		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
-			return fmt.Errorf("archive was not created: %s", archivePath)
-		}
+	if err := runTar(archivePath, parentDir, baseName, nil, opts); err != nil {
+		result.Err = fmt.Errorf("error archiving file %s: %w", srcPath, err)
+		return result
+	}
 
-		fmt.Printf("✅ File %s → %s\n", srcPath, archivePath)
-		cleanupOldBackups(subDir, "file_", item.Lifetime)
+	// Verify that archive was actually created
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		result.Err = fmt.Errorf("archive was not created: %s", archivePath)
+		return result
 	}
-	return nil
+
+	result.Archive = archivePath
+	fmt.Printf("✅ File %s → %s\n", srcPath, archivePath)
+	cleanupOldBackups(subDir, "file_", itemPolicy(item), opts.Encryption, cleanupMode{})
+	return result
 }
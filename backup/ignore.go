@@ -0,0 +1,193 @@
+// Package backup
+package backup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is honoured in every directory of a backed up tree and holds
+// additional exclude patterns relative to that directory.
+const ignoreFileName = ".backupignore"
+
+// ignorePattern is a single gitignore-style pattern.
+type ignorePattern struct {
+	base     string   // directory (relative to the item root) the pattern is defined in
+	segments []string // pattern split on "/", "**" matches any number of directories
+	negate   bool     // "!pattern" re-includes what an earlier pattern excluded
+	dirOnly  bool     // "pattern/" only matches directories
+}
+
+// parsePattern compiles a gitignore-style line. Empty lines and comments yield false.
+func parsePattern(line, base string) (ignorePattern, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	p := ignorePattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	// A pattern without a slash matches at any depth, otherwise it is anchored to base
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	p.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	return p, true
+}
+
+// matches reports whether rel (slash-separated, relative to the item root) matches p.
+func (p ignorePattern) matches(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, p.base+"/")
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against pattern segments with "**" support.
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], parts[0]); err != nil || !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// pathFilter decides which entries of a directory tree are archived, combining the
+// item's include/exclude lists with .backupignore files found in the tree.
+type pathFilter struct {
+	root     string // absolute path of the item being backed up
+	exclude  []ignorePattern
+	include  []ignorePattern
+	local    map[string][]ignorePattern // .backupignore patterns by directory
+	Excluded int                        // number of entries skipped so far
+}
+
+// newPathFilter compiles the configured patterns for the tree rooted at root.
+func newPathFilter(root string, exclude, include []string) *pathFilter {
+	f := &pathFilter{root: root, local: make(map[string][]ignorePattern)}
+	for _, line := range exclude {
+		if p, ok := parsePattern(line, ""); ok {
+			f.exclude = append(f.exclude, p)
+		}
+	}
+	for _, line := range include {
+		if p, ok := parsePattern(line, ""); ok {
+			f.include = append(f.include, p)
+		}
+	}
+	return f
+}
+
+// loadIgnoreFile reads the .backupignore file of the directory rel, if any.
+func (f *pathFilter) loadIgnoreFile(rel string) error {
+	file, err := os.Open(filepath.Join(f.root, filepath.FromSlash(rel), ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s in %s: %w", ignoreFileName, rel, err)
+	}
+	defer file.Close()
+
+	base := rel
+	if base == "." {
+		base = ""
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if p, ok := parsePattern(scanner.Text(), base); ok {
+			f.local[rel] = append(f.local[rel], p)
+		}
+	}
+	return scanner.Err()
+}
+
+// excluded reports whether rel should be left out of the archive. Patterns from
+// .backupignore files are applied from the root downwards and the item's own
+// exclude list last, so the configuration always has the final word.
+func (f *pathFilter) excluded(rel string, isDir bool) bool {
+	excluded := false
+	apply := func(patterns []ignorePattern) {
+		for _, p := range patterns {
+			if p.matches(rel, isDir) {
+				excluded = !p.negate
+			}
+		}
+	}
+
+	apply(f.local["."])
+	dir := ""
+	for _, part := range strings.Split(path.Dir(rel), "/") {
+		if part == "." {
+			break
+		}
+		dir = path.Join(dir, part)
+		apply(f.local[dir])
+	}
+	apply(f.exclude)
+	return excluded
+}
+
+// included reports whether rel matches the include list. An empty list includes everything.
+func (f *pathFilter) included(rel string, isDir bool) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+	included := false
+	for _, p := range f.include {
+		if p.matches(rel, isDir) {
+			included = !p.negate
+		}
+	}
+	return included
+}
+
+// describePatterns renders the configured patterns for log output.
+func describePatterns(exclude, include []string) string {
+	var parts []string
+	if len(exclude) > 0 {
+		parts = append(parts, "exclude: "+strings.Join(exclude, ", "))
+	}
+	if len(include) > 0 {
+		parts = append(parts, "include: "+strings.Join(include, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,291 @@
+// Package backup
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+)
+
+// Backup modes for directory items.
+const (
+	ModeFull         = "full"
+	ModeIncremental  = "incremental"
+	ModeDifferential = "differential"
+)
+
+const (
+	// manifestEntry is the first entry of incremental/differential archives and
+	// of full archives taken in those modes.
+	manifestEntry = ".backup-manifest.json"
+	// deletedEntry is the last entry of incremental/differential archives and
+	// lists the names removed since the base archive, one per line.
+	deletedEntry = ".backup-deleted"
+	// indexDirName holds the snapshot index of every archive of an item.
+	indexDirName = ".index"
+	// defaultFullInterval is used when neither fullBackupDay nor fullBackupInterval is set.
+	defaultFullInterval = 7
+)
+
+// archiveManifest describes how an archive relates to earlier ones.
+type archiveManifest struct {
+	Type    string    `json:"type"`           // full, incremental or differential
+	Base    string    `json:"base,omitempty"` // archive this one contains changes against
+	Created time.Time `json:"created"`
+}
+
+// fileState is what is remembered about each archived entry to detect changes.
+type fileState struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix nanoseconds
+	Inode   uint64 `json:"inode,omitempty"`
+	Mode    uint32 `json:"mode"`
+}
+
+// snapshotIndex is persisted in <subDir>/.index/<archive>.json after every
+// incremental-mode run and is the base for the next one.
+type snapshotIndex struct {
+	Archive string `json:"archive"`
+	archiveManifest
+	Files map[string]fileState `json:"files"`
+}
+
+// snapshotBuilder records file states while an archive is written and decides
+// which files changed compared to the base snapshot.
+type snapshotBuilder struct {
+	base  map[string]fileState // nil for a full backup
+	files map[string]fileState
+}
+
+// newSnapshotBuilder starts a snapshot relative to base (nil for a full backup).
+func newSnapshotBuilder(base *snapshotIndex) *snapshotBuilder {
+	b := &snapshotBuilder{files: make(map[string]fileState)}
+	if base != nil {
+		b.base = base.Files
+	}
+	return b
+}
+
+// changed records the state of name and reports whether its content must be
+// archived. Directories are always archived so their metadata can be replayed.
+func (b *snapshotBuilder) changed(name string, info os.FileInfo) bool {
+	state := fileState{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   inodeOf(info),
+		Mode:    uint32(info.Mode()),
+	}
+	b.files[name] = state
+	if info.IsDir() || b.base == nil {
+		return true
+	}
+	prev, ok := b.base[name]
+	return !ok || prev != state
+}
+
+// deleted returns the names present in the base snapshot but not in this one.
+func (b *snapshotBuilder) deleted() []string {
+	var names []string
+	for name := range b.base {
+		if _, ok := b.files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadIndexes reads all snapshot indexes of an item, oldest first.
+func loadIndexes(subDir string) ([]*snapshotIndex, error) {
+	entries, err := os.ReadDir(filepath.Join(subDir, indexDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot index in %s: %w", subDir, err)
+	}
+
+	var indexes []*snapshotIndex
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		idx, err := readIndex(subDir, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		// Ignore indexes whose archive has been removed, and those copied back
+		// from a destination, which lack the file list (see uploadContent)
+		if _, err := os.Stat(filepath.Join(subDir, idx.Archive)); err != nil || idx.Files == nil {
+			continue
+		}
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Created.Before(indexes[j].Created) })
+	return indexes, nil
+}
+
+// readIndex reads the snapshot index of one archive.
+func readIndex(subDir, archiveName string) (*snapshotIndex, error) {
+	path := filepath.Join(subDir, indexDirName, archiveName+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot index %s: %w", path, err)
+	}
+	var idx snapshotIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("error parsing snapshot index %s: %w", path, err)
+	}
+	return &idx, nil
+}
+
+// writeIndex persists the snapshot index of an archive.
+func writeIndex(subDir string, idx *snapshotIndex) error {
+	dir := filepath.Join(subDir, indexDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot index: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(dir, idx.Archive+".json"), data)
+}
+
+// removeIndex deletes the snapshot index of an archive, if any.
+func removeIndex(subDir, archiveName string) {
+	os.Remove(filepath.Join(subDir, indexDirName, archiveName+".json"))
+}
+
+// planSnapshot decides whether this run of item is a full backup or relative to
+// an earlier snapshot, and returns the type and base index (nil for full).
+func planSnapshot(item config.Item, indexes []*snapshotIndex, now time.Time) (string, *snapshotIndex) {
+	var lastFull *snapshotIndex
+	for _, idx := range indexes {
+		if idx.Type == ModeFull {
+			lastFull = idx
+		}
+	}
+	if lastFull == nil {
+		return ModeFull, nil
+	}
+
+	if item.FullBackupDay != "" {
+		if strings.EqualFold(now.Weekday().String(), item.FullBackupDay) && !sameDay(lastFull.Created, now) {
+			return ModeFull, nil
+		}
+	}
+	interval := item.FullBackupInterval
+	if interval <= 0 && item.FullBackupDay == "" {
+		interval = defaultFullInterval
+	}
+	if interval > 0 && !lastFull.Created.After(now.AddDate(0, 0, -interval)) {
+		return ModeFull, nil
+	}
+
+	if strings.ToLower(item.Mode) == ModeDifferential {
+		return ModeDifferential, lastFull
+	}
+	return ModeIncremental, indexes[len(indexes)-1]
+}
+
+// sameDay reports whether a and b fall on the same calendar day.
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// readManifest returns the manifest of an archive. Archives written without one
+// (full mode, or before incremental backups existed) are reported as full.
+func readManifest(archivePath string, enc *config.Encryption) (*archiveManifest, error) {
+	tr, closer, err := openArchive(archivePath, enc)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != manifestEntry {
+		return &archiveManifest{Type: ModeFull}, nil
+	}
+	var m archiveManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest of %s: %w", archivePath, err)
+	}
+	return &m, nil
+}
+
+// chainBases returns every archive that one of keep depends on, following the
+// base references returned by baseOf until a full backup is reached.
+func chainBases(keep []string, baseOf func(name string) string) map[string]bool {
+	protected := make(map[string]bool)
+	for _, name := range keep {
+		for base := baseOf(name); base != "" && !protected[base]; base = baseOf(base) {
+			protected[base] = true
+		}
+	}
+	return protected
+}
+
+// runSnapshotTar archives baseDir/entryName for an item in incremental or
+// differential mode: only entries changed since the base snapshot are written,
+// followed by the list of deleted names, and the new snapshot index is persisted.
+func runSnapshotTar(targetArchive, subDir, baseDir, entryName string, item config.Item, filter *pathFilter, opts ArchiveOptions) (*archiveManifest, error) {
+	indexes, err := loadIndexes(subDir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	snapshotType, base := planSnapshot(item, indexes, now)
+	manifest := archiveManifest{Type: snapshotType, Created: now}
+	if base != nil {
+		manifest.Base = base.Archive
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	archive, err := createArchive(targetArchive, opts)
+	if err != nil {
+		return nil, err
+	}
+	archive.snapshot = newSnapshotBuilder(base)
+
+	if err := archive.addBytes(manifestEntry, manifestData); err != nil {
+		archive.Abort()
+		return nil, err
+	}
+	if err := archive.addTree(baseDir, entryName, filter); err != nil {
+		archive.Abort()
+		return nil, err
+	}
+	if base != nil {
+		deleted := strings.Join(archive.snapshot.deleted(), "\n")
+		if err := archive.addBytes(deletedEntry, []byte(deleted)); err != nil {
+			archive.Abort()
+			return nil, err
+		}
+	}
+	if err := archive.Commit(); err != nil {
+		return nil, err
+	}
+
+	idx := &snapshotIndex{
+		Archive:         filepath.Base(targetArchive),
+		archiveManifest: manifest,
+		Files:           archive.snapshot.files,
+	}
+	if err := writeIndex(subDir, idx); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,160 @@
+// Package backup
+package backup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"backup-tool/config"
+)
+
+// localDestination mirrors backups into a directory on a mounted filesystem.
+type localDestination struct {
+	name     string
+	root     string
+	hardlink bool // link archives instead of copying them where possible
+	verify   bool // read copies back and compare their SHA-256 before renaming
+}
+
+// openLocalDestination returns the mirror in cfg.Path. Directories are created
+// by Put as files are stored, so opening it changes nothing on disk.
+func openLocalDestination(name string, cfg config.LocalDestination, verify bool) (*localDestination, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("no path configured")
+	}
+	return &localDestination{name: name, root: cfg.Path, hardlink: cfg.Hardlink, verify: verify}, nil
+}
+
+// path returns the local path of rel.
+func (d *localDestination) path(rel string) string {
+	return filepath.Join(d.root, filepath.FromSlash(rel))
+}
+
+// Name implements Destination.
+func (d *localDestination) Name() string { return d.name }
+
+// Put implements Destination. If hardlinks are enabled and r is a file on the
+// same filesystem, the file is linked; otherwise it is copied to a temporary
+// .partial name, synced and checked (size, and SHA-256 if verify is set)
+// before it is renamed to its final name.
+func (d *localDestination) Put(rel string, r io.Reader, size int64) error {
+	dstPath := d.path(rel)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", dstPath, err)
+	}
+	tmpPath := d.path(partialName(rel))
+
+	if f, ok := r.(*os.File); ok && d.hardlink {
+		os.Remove(tmpPath)
+		if err := os.Link(f.Name(), tmpPath); err == nil {
+			if err := os.Rename(tmpPath, dstPath); err != nil {
+				os.Remove(tmpPath)
+				return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, dstPath, err)
+			}
+			return nil
+		}
+		// Different filesystem or no hardlink support: copy instead
+	}
+
+	dstFile, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", tmpPath, err)
+	}
+
+	hash := sha256.New()
+	written, err := io.Copy(dstFile, io.TeeReader(r, hash))
+	if err == nil {
+		err = dstFile.Sync()
+	}
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written != size {
+		err = fmt.Errorf("read %d bytes, expected %d", written, size)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error copying %s to %s: %w", rel, d.root, err)
+	}
+
+	if d.verify {
+		if err := d.verifyCopy(tmpPath, hash.Sum(nil)); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("verification of %s in %s failed: %w", rel, d.root, err)
+		}
+	}
+
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, dstPath, err)
+	}
+	return nil
+}
+
+// verifyCopy reads a copied file back and compares its SHA-256 with sum.
+func (d *localDestination) verifyCopy(path string, sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return compareSHA256(f, sum)
+}
+
+// List implements Destination.
+func (d *localDestination) List(rel string) ([]RemoteFile, error) {
+	entries, err := os.ReadDir(d.path(rel))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s in %s: %w", rel, d.root, err)
+	}
+	files := make([]RemoteFile, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, remoteFileFromInfo(fi))
+	}
+	return files, nil
+}
+
+// Stat implements Destination.
+func (d *localDestination) Stat(rel string) (RemoteFile, error) {
+	fi, err := os.Stat(d.path(rel))
+	if err != nil {
+		return RemoteFile{}, err
+	}
+	return remoteFileFromInfo(fi), nil
+}
+
+// Delete implements Destination.
+func (d *localDestination) Delete(rel string) error {
+	return os.Remove(d.path(rel))
+}
+
+// Move implements Destination.
+func (d *localDestination) Move(from, to string) error {
+	dstPath := d.path(to)
+	// os.Rename silently replaces an existing target
+	if _, err := os.Lstat(dstPath); err == nil {
+		return fmt.Errorf("failed to move %s to %s: target exists", from, to)
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", dstPath, err)
+	}
+	return os.Rename(d.path(from), dstPath)
+}
+
+// Get implements Destination.
+func (d *localDestination) Get(rel string) (io.ReadCloser, error) {
+	return os.Open(d.path(rel))
+}
+
+// Close implements Destination.
+func (d *localDestination) Close() error { return nil }
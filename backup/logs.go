@@ -2,58 +2,86 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
 
 	"backup-tool/config"
 )
 
 // BackupLogs archives log files and then truncates the original log files.
-// Creates structure: <localBackupPath>/logs/<basename>/log_YYYYMMDD_HHMMSS.tar.gz
-func BackupLogs(localPath string, items []config.Item) error {
+// Creates structure: <localBackupPath>/logs/<name>/log_YYYYMMDD_HHMMSS.tar.gz (extension follows the compression)
+func BackupLogs(localPath string, items []config.Item, opts ArchiveOptions, summary *Summary) error {
+	var errs []error
 	for _, item := range items {
-		srcPath := item.Path
-		info, err := os.Stat(srcPath)
-		if os.IsNotExist(err) {
-			fmt.Printf("⚠️ Log file %s does not exist — skipping\n", srcPath)
-			continue
-		}
-		if err != nil {
-			return fmt.Errorf("error checking log file %s: %w", srcPath, err)
-		}
-		if info.IsDir() {
-			return fmt.Errorf("%s is a directory, expected log file", srcPath)
+		result := backupLog(localPath, item, opts.withCompression(item.Compression))
+		summary.add(result)
+		if result.Err != nil {
+			errs = append(errs, result.Err)
 		}
+	}
+	return errors.Join(errs...)
+}
 
-		baseName := filepath.Base(srcPath)
-		subDir, err := ensureBackupSubdir(localPath, "logs", baseName)
-		if err != nil {
-			return fmt.Errorf("failed to create subdirectory for log %s: %w", baseName, err)
-		}
+// backupLog archives and truncates a single log file item.
+func backupLog(localPath string, item config.Item, opts ArchiveOptions) ItemResult {
+	srcPath := item.Path
+	result := ItemResult{Kind: "log", Source: srcPath}
 
-		archiveName := fmt.Sprintf("log_%s.tar.gz", time.Now().Format("20060102_150405"))
-		archivePath := filepath.Join(subDir, archiveName)
+	info, err := os.Stat(srcPath)
+	if os.IsNotExist(err) {
+		fmt.Printf("⚠️ Log file %s does not exist — skipping\n", srcPath)
+		result.Skipped = true
+		return result
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("error checking log file %s: %w", srcPath, err)
+		return result
+	}
+	if info.IsDir() {
+		result.Err = fmt.Errorf("%s is a directory, expected log file", srcPath)
+		return result
+	}
 
-		parentDir := filepath.Dir(srcPath)
-		if err := runTar(archivePath, parentDir, baseName); err != nil {
-			return fmt.Errorf("error archiving log file %s: %w", srcPath, err)
-		}
+	baseName := filepath.Base(srcPath)
+	name := item.BackupName()
+	if opts.DryRun {
+		result.Archive = planArchive(localPath, "logs", name, "log_", srcPath, itemPolicy(item), opts)
+		result.Planned = true
+		fmt.Printf("🔍 Would truncate %s (%d bytes)\n", srcPath, info.Size())
+		return result
+	}
 
-		// Verify that archive was actually created
-		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
-			return fmt.Errorf("archive was not created: %s", archivePath)
-		}
+	subDir, err := ensureBackupSubdir(localPath, "logs", name)
+	if err != nil {
+		result.Err = fmt.Errorf("failed to create subdirectory for log %s: %w", name, err)
+		return result
+	}
 
-		// Truncate original log file after successful backup
-		if err := os.Truncate(srcPath, 0); err != nil {
-			return fmt.Errorf("failed to truncate log file %s after backup: %w", srcPath, err)
-		}
+	archiveName := archiveFileName("log_", opts)
+	archivePath := filepath.Join(subDir, archiveName)
 
-		fmt.Printf("✅ Log file %s → %s (source truncated)\n", srcPath, archivePath)
-		cleanupOldBackups(subDir, "log_", item.Lifetime)
+	parentDir := filepath.Dir(srcPath)
+	if err := runTar(archivePath, parentDir, baseName, nil, opts); err != nil {
+		result.Err = fmt.Errorf("error archiving log file %s: %w", srcPath, err)
+		return result
 	}
-	return nil
-}
 
+	// Verify that archive was actually created
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		result.Err = fmt.Errorf("archive was not created: %s", archivePath)
+		return result
+	}
+
+	// Truncate original log file after successful backup
+	if err := os.Truncate(srcPath, 0); err != nil {
+		result.Err = fmt.Errorf("failed to truncate log file %s after backup: %w", srcPath, err)
+		return result
+	}
+
+	result.Archive = archivePath
+	fmt.Printf("✅ Log file %s → %s (source truncated)\n", srcPath, archivePath)
+	cleanupOldBackups(subDir, "log_", itemPolicy(item), opts.Encryption, cleanupMode{})
+	return result
+}
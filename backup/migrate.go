@@ -0,0 +1,227 @@
+// Package backup
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"backup-tool/config"
+)
+
+// layoutMove renames the backup directory of an item from the base name of
+// its path, used before items had names, to its name.
+type layoutMove struct {
+	From string // e.g. dirs/html
+	To   string // e.g. dirs/var_www_html
+}
+
+// layoutMoves returns the directories of the items of cfg that may still be
+// stored under their legacy name, and the legacy directories several items
+// map to (with the paths of those items), which cannot be moved since their
+// archives cannot be told apart.
+func layoutMoves(cfg *config.Config) ([]layoutMove, map[string][]string) {
+	var moves []layoutMove
+	shared := make(map[string][]string)
+	for _, category := range []struct {
+		dir   string
+		items []config.Item
+	}{
+		{"dirs", cfg.Dirs},
+		{"files", cfg.Files},
+		{"logs", cfg.Logs},
+	} {
+		claims := make(map[string][]string) // legacy name -> paths of the items
+		names := make(map[string]bool)
+		for _, item := range category.items {
+			claims[item.LegacyName()] = append(claims[item.LegacyName()], item.Path)
+			names[item.BackupName()] = true
+		}
+		for _, item := range category.items {
+			legacy, name := item.LegacyName(), item.BackupName()
+			switch {
+			case legacy == name || names[legacy]:
+				// The directory belongs to the item named like it
+			case len(claims[legacy]) > 1:
+				shared[category.dir+"/"+legacy] = claims[legacy]
+			default:
+				moves = append(moves, layoutMove{From: category.dir + "/" + legacy, To: category.dir + "/" + name})
+			}
+		}
+	}
+	return moves, shared
+}
+
+// layoutMarker records, below localBackupPath, where backups stored under the
+// base name of an item's path have been moved to the item's name. It is not
+// uploaded.
+const layoutMarker = ".layout-v2.json"
+
+// layoutState is the content of layoutMarker.
+type layoutState struct {
+	Local        bool     `json:"local"`
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+// MigrateLayout moves backups stored under the base name of an item's path
+// (dirs/html) to the item's name (dirs/var_www_html), locally and on every
+// destination, together with their checksums, snapshot indexes and repository
+// snapshots. This is done once per location: completed ones are recorded in
+// layoutMarker and skipped afterwards, also for items added later. With dryRun
+// the moves are only listed.
+func MigrateLayout(cfg *config.Config, dryRun bool) error {
+	markerPath := filepath.Join(cfg.LocalBackupPath, layoutMarker)
+	var state layoutState
+	if data, err := os.ReadFile(markerPath); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("error parsing %s: %w", markerPath, err)
+		}
+	}
+	done := make(map[string]bool)
+	for _, name := range state.Destinations {
+		done[name] = true
+	}
+	var pending []config.Destination
+	for _, destCfg := range cfg.RemoteDestinations() {
+		if !done[destCfg.Name] {
+			pending = append(pending, destCfg)
+		}
+	}
+	if state.Local && len(pending) == 0 {
+		return nil
+	}
+
+	moves, shared := layoutMoves(cfg)
+	var failed []string
+	if !state.Local {
+		local, err := openLocalDestination(cfg.LocalBackupPath, config.LocalDestination{Path: cfg.LocalBackupPath}, false)
+		if err == nil {
+			err = migrateDestination(local, moves, shared, dryRun)
+		}
+		if err != nil {
+			fmt.Printf("⚠️ Error moving backups in %s: %v\n", cfg.LocalBackupPath, err)
+			failed = append(failed, cfg.LocalBackupPath)
+		} else {
+			state.Local = true
+		}
+	}
+
+	for _, destCfg := range pending {
+		dest, err := OpenDestination(destCfg)
+		if err == nil {
+			err = migrateDestination(dest, moves, shared, dryRun)
+			dest.Close()
+		}
+		if err != nil {
+			fmt.Printf("⚠️ Error moving backups on %s: %v\n", destCfg.Name, err)
+			failed = append(failed, destCfg.Name)
+			continue
+		}
+		state.Destinations = append(state.Destinations, destCfg.Name)
+	}
+
+	if !dryRun {
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err == nil {
+			err = os.MkdirAll(cfg.LocalBackupPath, 0755)
+		}
+		if err == nil {
+			err = writeFileAtomic(markerPath, data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record the moved backups: %w", err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("moving backups to the item names failed on %s (retried on the next run)", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// migrateDestination applies moves to dest and warns about shared legacy
+// directories that still hold backups.
+func migrateDestination(dest Destination, moves []layoutMove, shared map[string][]string, dryRun bool) error {
+	for _, m := range moves {
+		for _, root := range []string{"", repositoryDirName + "/snapshots/"} {
+			moved, err := moveTree(dest, root+m.From, root+m.To, dryRun)
+			if err != nil {
+				return err
+			}
+			if moved > 0 && dryRun {
+				fmt.Printf("📦 Would move %d files from %s to %s on %s\n", moved, root+m.From, root+m.To, dest.Name())
+			} else if moved > 0 {
+				fmt.Printf("📦 Moved %d files from %s to %s on %s\n", moved, root+m.From, root+m.To, dest.Name())
+			}
+		}
+	}
+
+	dirs := make([]string, 0, len(shared))
+	for dir := range shared {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		files, err := dest.List(dir)
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			fmt.Printf("⚠️ %s on %s may hold backups of several items (%s): move them to the directories named after the items by hand\n",
+				dir, dest.Name(), strings.Join(shared[dir], ", "))
+		}
+	}
+	return nil
+}
+
+// moveTree moves the files below from to the same place below to and returns
+// how many were (or, with dryRun, would be) moved. Files that already exist
+// below to are left in place; from is removed once it is empty.
+func moveTree(dest Destination, from, to string, dryRun bool) (int, error) {
+	files, err := dest.List(from)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		// Left empty by an earlier, interrupted move
+		if _, err := dest.Stat(from); err == nil && !dryRun {
+			dest.Delete(from)
+		}
+		return 0, nil
+	}
+
+	moved := 0
+	for _, f := range files {
+		src, dst := path.Join(from, f.Name), path.Join(to, f.Name)
+		if f.IsDir {
+			n, err := moveTree(dest, src, dst, dryRun)
+			moved += n
+			if err != nil {
+				return moved, err
+			}
+			continue
+		}
+		if _, err := dest.Stat(dst); err == nil {
+			fmt.Printf("⚠️ %s already exists on %s, leaving %s in place\n", dst, dest.Name(), src)
+			continue
+		}
+		if !dryRun {
+			if err := dest.Move(src, dst); err != nil {
+				return moved, err
+			}
+		}
+		moved++
+	}
+
+	// Only an empty directory is removed: deleting a WebDAV collection
+	// would delete its contents as well
+	if !dryRun {
+		if rest, err := dest.List(from); err == nil && len(rest) == 0 {
+			dest.Delete(from)
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,89 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"backup-tool/config"
+)
+
+// Prune applies the retention of every item and the maxTotalSize limits to
+// localBackupPath and to all destinations without taking new backups. Every backup is listed with the
+// rules that keep it; with dryRun nothing is deleted.
+func Prune(cfg *config.Config, dryRun bool) error {
+	mode := cleanupMode{dryRun: dryRun, explain: true}
+	if err := MigrateLayout(cfg, dryRun); err != nil {
+		fmt.Printf("⚠️ %v\n", err)
+	}
+
+	fmt.Printf("🧹 Pruning %s...\n", cfg.LocalBackupPath)
+	repo := &repository{root: filepath.Join(cfg.LocalBackupPath, repositoryDirName), enc: cfg.Encryption}
+	pruned := 0
+	for _, item := range cfg.Dirs {
+		pruned += pruneLocalItem(cfg.LocalBackupPath, repo, "dirs", "dir_", item, mode)
+	}
+	for _, item := range cfg.Files {
+		pruned += pruneLocalItem(cfg.LocalBackupPath, repo, "files", "file_", item, mode)
+	}
+	for _, item := range cfg.Logs {
+		pruned += pruneLocalItem(cfg.LocalBackupPath, repo, "logs", "log_", item, mode)
+	}
+	for _, db := range cfg.Databases {
+		pruneLocalDir(filepath.Join(cfg.LocalBackupPath, "databases", db.Name), "db_", databasePolicy(db), cfg.Encryption, mode)
+	}
+	if pruned > 0 && !dryRun {
+		if err := repo.collectGarbage(); err != nil {
+			fmt.Printf("⚠️ %v\n", err)
+		}
+	}
+	var failed []string
+	if cfg.MaxTotalSize != "" {
+		if err := enforceLocalQuota(cfg, nil, mode); err != nil {
+			fmt.Printf("⚠️ Error enforcing maxTotalSize on %s: %v\n", cfg.LocalBackupPath, err)
+			failed = append(failed, cfg.LocalBackupPath)
+		}
+	}
+
+	items := RemoteItems(cfg, nil)
+	for _, dest := range cfg.RemoteDestinations() {
+		fmt.Printf("🧹 Pruning %s...\n", dest.Name)
+		if err := cleanupDestination(dest, items, cfg.Encryption, mode); err != nil {
+			fmt.Printf("⚠️ Error pruning %s: %v\n", dest.Name, err)
+			failed = append(failed, dest.Name)
+			continue
+		}
+		if dest.MaxTotalSize != "" {
+			if err := enforceDestinationQuota(cfg, dest, nil, mode); err != nil {
+				fmt.Printf("⚠️ Error enforcing maxTotalSize on %s: %v\n", dest.Name, err)
+				failed = append(failed, dest.Name)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("pruning failed on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// pruneLocalItem applies the retention of a dir, file or log item to its
+// archives or repository snapshots and returns how many snapshots were removed.
+func pruneLocalItem(localPath string, repo *repository, category, prefix string, item config.Item, mode cleanupMode) int {
+	name := item.BackupName()
+	if strings.ToLower(item.Storage) == StorageRepository {
+		return repo.pruneSnapshots(category, name, itemPolicy(item), "", mode)
+	}
+	pruneLocalDir(filepath.Join(localPath, category, name), prefix, itemPolicy(item), repo.enc, mode)
+	return 0
+}
+
+// pruneLocalDir applies policy to the archives in dir, if it exists.
+func pruneLocalDir(dir, prefix string, policy retentionPolicy, enc *config.Encryption, mode cleanupMode) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		fmt.Printf("ℹ️ Directory %s not found (backups may not exist yet)\n", dir)
+		return
+	}
+	cleanupOldBackups(dir, prefix, policy, enc, mode)
+}
@@ -0,0 +1,262 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"backup-tool/config"
+	"backup-tool/utils"
+)
+
+// archiveCategories are the top-level directories holding archives, one
+// subdirectory per item.
+var archiveCategories = []string{"dirs", "files", "logs", "databases"}
+
+// quotaCandidate is an archive that may be deleted to meet a quota.
+type quotaCandidate struct {
+	datedBackup
+	Dir string // item directory, e.g. dirs/www
+}
+
+// path returns the archive's path relative to the backup root.
+func (c quotaCandidate) path() string {
+	return c.Dir + "/" + c.Name
+}
+
+// quotaFloor is what the quota leaves of the archives in an item directory.
+type quotaFloor struct {
+	keep int  // newest non-empty archives that are never deleted (at least 1)
+	skip bool // the item's backup failed in this run: delete none of them
+}
+
+// quotaFloors returns the floor of every configured item by its directory
+// (e.g. dirs/www). minKeep overrides the items' minKeep if set. Directories
+// of items no longer configured keep their newest archive.
+func quotaFloors(cfg *config.Config, summary *Summary, minKeep *int) map[string]quotaFloor {
+	floors := make(map[string]quotaFloor)
+	for _, item := range configItems(cfg, summary) {
+		keep := minKeepOf(item.MinKeep)
+		if minKeep != nil {
+			keep = *minKeep
+		}
+		floors[item.Dir] = quotaFloor{keep: max(keep, 1), skip: item.Failed}
+	}
+	return floors
+}
+
+// EnforceLocalQuota deletes the oldest archives in the backup root until it
+// uses at most cfg.MaxTotalSize (e.g. "200G"). The newest minKeep archives of
+// every item are never deleted, nor are the archives of items whose backup
+// failed in the run recorded by summary. With dryRun the archives are only
+// listed.
+func EnforceLocalQuota(cfg *config.Config, summary *Summary, dryRun bool) error {
+	return enforceLocalQuota(cfg, summary, cleanupMode{dryRun: dryRun})
+}
+
+// enforceLocalQuota is EnforceLocalQuota with a cleanup mode.
+func enforceLocalQuota(cfg *config.Config, summary *Summary, mode cleanupMode) error {
+	dest, err := openLocalDestination(cfg.LocalBackupPath, config.LocalDestination{Path: cfg.LocalBackupPath}, false)
+	if err != nil {
+		return err
+	}
+	return enforceQuota(dest, cfg.MaxTotalSize, quotaFloors(cfg, summary, nil), mode)
+}
+
+// EnforceDestinationQuota applies the maxTotalSize of a destination like
+// EnforceLocalQuota; the destination's minKeep takes precedence over the items'.
+func EnforceDestinationQuota(cfg *config.Config, dest config.Destination, summary *Summary, dryRun bool) error {
+	return enforceDestinationQuota(cfg, dest, summary, cleanupMode{dryRun: dryRun})
+}
+
+// enforceDestinationQuota is EnforceDestinationQuota with a cleanup mode.
+func enforceDestinationQuota(cfg *config.Config, destCfg config.Destination, summary *Summary, mode cleanupMode) error {
+	dest, err := OpenDestination(destCfg)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return enforceQuota(dest, destCfg.MaxTotalSize, quotaFloors(cfg, summary, destCfg.MinKeep), mode)
+}
+
+// enforceQuota deletes archives on dest, oldest first across all items, until
+// the archives stored there take at most maxTotalSize. The archives floors
+// keep and every archive a kept one depends on are not deleted. The
+// repository is not counted: only its retention reduces it.
+func enforceQuota(dest Destination, maxTotalSize string, floors map[string]quotaFloor, mode cleanupMode) error {
+	quota, err := utils.ParseSize(maxTotalSize)
+	if err != nil {
+		return fmt.Errorf("maxTotalSize: %w", err)
+	}
+
+	var usage int64
+	for _, category := range archiveCategories {
+		size, err := treeSize(dest, category)
+		if err != nil {
+			return err
+		}
+		usage += size
+	}
+	if usage <= quota {
+		return nil
+	}
+	fmt.Printf("⚠️ %s uses %s, more than maxTotalSize %s\n", dest.Name(), utils.FormatSize(usage), utils.FormatSize(quota))
+
+	candidates, kept, sizes, err := quotaCandidates(dest, floors)
+	if err != nil {
+		return err
+	}
+
+	// Base archive of each archive, read once, to keep incremental chains intact
+	bases := make(map[string]string)
+	baseOf := func(p string) string {
+		if base, ok := bases[p]; ok {
+			return base
+		}
+		base := ""
+		dir, name := path.Split(p)
+		if idx, err := readRemoteIndex(dest, path.Clean(dir), name); err == nil && idx.Base != "" {
+			base = dir + idx.Base
+		}
+		bases[p] = base
+		return base
+	}
+
+	// The chains of the kept archives are never deleted; those of the
+	// other archives only once the archives themselves are
+	protected := chainBases(kept, baseOf)
+	deleted := make(map[string]bool)
+	dependedOn := func(c quotaCandidate) bool {
+		if protected[c.path()] {
+			return true
+		}
+		for _, other := range candidates {
+			if !deleted[other.path()] && other.path() != c.path() && baseOf(other.path()) == c.path() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Deleting a dependent archive can free its base, so repeat until nothing changes
+	for progress := true; progress && usage > quota; {
+		progress = false
+		for _, c := range candidates {
+			if usage <= quota {
+				break
+			}
+			if deleted[c.path()] || dependedOn(c) {
+				continue
+			}
+			index := c.Dir + "/" + indexDirName + "/" + c.Name + ".json"
+			freed := c.Size + sizes[c.path()+checksumSuffix] + sizes[index]
+			if mode.dryRun {
+				fmt.Printf("🗑️ Would delete %s on %s: oldest backup while over maxTotalSize (%s used, limit %s)\n",
+					c.path(), dest.Name(), utils.FormatSize(usage), utils.FormatSize(quota))
+			} else {
+				if err := dest.Delete(c.path()); err != nil {
+					fmt.Printf("⚠️ Failed to delete %s on %s: %v\n", c.path(), dest.Name(), err)
+					continue
+				}
+				dest.Delete(index)
+				dest.Delete(c.path() + checksumSuffix)
+				fmt.Printf("🗑️ Deleted %s on %s: oldest backup while over maxTotalSize (%s used, limit %s)\n",
+					c.path(), dest.Name(), utils.FormatSize(usage), utils.FormatSize(quota))
+			}
+			deleted[c.path()] = true
+			usage -= freed
+			progress = true
+		}
+	}
+
+	if usage > quota {
+		left := 0
+		for _, c := range candidates {
+			if !deleted[c.path()] {
+				left++
+			}
+		}
+		fmt.Printf("⚠️ %s still uses %s for archives, more than maxTotalSize %s: the %d backups left are within the minKeep of their item, belong to an item whose backup failed, are needed by a kept incremental backup, or could not be deleted\n",
+			dest.Name(), utils.FormatSize(usage), utils.FormatSize(quota), len(kept)+left)
+	} else {
+		fmt.Printf("✅ %s uses %s for archives, within maxTotalSize %s\n", dest.Name(), utils.FormatSize(usage), utils.FormatSize(quota))
+	}
+	return nil
+}
+
+// quotaCandidates returns the archives on dest that floors (by item directory)
+// allow to delete, oldest first, the paths of the archives they keep, and the
+// sizes of all files in the item directories and their snapshot indexes by path.
+func quotaCandidates(dest Destination, floors map[string]quotaFloor) ([]quotaCandidate, []string, map[string]int64, error) {
+	var candidates []quotaCandidate
+	var kept []string
+	sizes := make(map[string]int64)
+	for _, category := range archiveCategories {
+		items, err := dest.List(category)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, item := range items {
+			if !item.IsDir {
+				continue
+			}
+			dir := category + "/" + item.Name
+			files, err := dest.List(dir)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for _, f := range files {
+				sizes[dir+"/"+f.Name] = f.Size
+			}
+			indexes, err := dest.List(dir + "/" + indexDirName)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for _, f := range indexes {
+				sizes[dir+"/"+indexDirName+"/"+f.Name] = f.Size
+			}
+			floor, ok := floors[dir]
+			if !ok {
+				floor = quotaFloor{keep: 1}
+			}
+			if floor.skip {
+				fmt.Printf("⚠️ Not deleting backups of %s for maxTotalSize: its backup failed in this run\n", dir)
+			}
+			remaining := floor.keep
+			for _, b := range datedBackups(files, "") {
+				if floor.skip || remaining > 0 {
+					kept = append(kept, dir+"/"+b.Name)
+					if b.Size > 0 {
+						remaining--
+					}
+					continue
+				}
+				candidates = append(candidates, quotaCandidate{datedBackup: b, Dir: dir})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Time.Before(candidates[j].Time) })
+	return candidates, kept, sizes, nil
+}
+
+// treeSize returns the total size of the files below dir on dest.
+func treeSize(dest Destination, dir string) (int64, error) {
+	files, err := dest.List(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, f := range files {
+		if f.IsDir {
+			size, err := treeSize(dest, path.Join(dir, f.Name))
+			if err != nil {
+				return 0, err
+			}
+			total += size
+			continue
+		}
+		total += f.Size
+	}
+	return total, nil
+}
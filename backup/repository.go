@@ -0,0 +1,838 @@
+// Package backup
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+	"backup-tool/utils"
+)
+
+// Storage formats for dirs and files items.
+const (
+	StorageArchive    = "archive"
+	StorageRepository = "repository"
+)
+
+const (
+	// repositoryDirName is the repository root below localBackupPath.
+	repositoryDirName = "repository"
+
+	// Content-defined chunking parameters: chunk boundaries are placed where the
+	// top chunkMaskBits bits of the rolling gear hash (which depend on the last
+	// 64 bytes) are zero, so inserting or removing bytes only changes the chunks
+	// around the edit.
+	chunkMinSize  = 512 << 10
+	chunkMaxSize  = 8 << 20
+	chunkMaskBits = 20 // average chunk size of about 1 MiB
+)
+
+// gearTable holds the per-byte values of the rolling hash. It is derived from a
+// fixed seed, since chunk boundaries must be identical across runs.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// repoEntry is one file system object recorded in a snapshot.
+type repoEntry struct {
+	Name     string   `json:"name"` // relative to the parent of the backed up path
+	Type     string   `json:"type"` // dir, file, symlink or hardlink
+	Mode     int64    `json:"mode"`
+	UID      int      `json:"uid"`
+	GID      int      `json:"gid"`
+	ModTime  int64    `json:"mtime"` // Unix nanoseconds
+	Size     int64    `json:"size,omitempty"`
+	Linkname string   `json:"linkname,omitempty"`
+	Chunks   []string `json:"chunks,omitempty"` // id of each chunk, in order (see chunkID)
+}
+
+// repoSnapshot is the manifest written for every repository backup run.
+type repoSnapshot struct {
+	Source  string      `json:"source"`
+	Created time.Time   `json:"created"`
+	Entries []repoEntry `json:"entries"`
+}
+
+// repository stores file contents as deduplicated, content-defined chunks.
+// Layout below <localBackupPath>/repository:
+//
+//	chunks/<aa>/<id>                            gzip-compressed chunk data
+//	snapshots/<category>/<name>/<prefix>YYYYMMDD_HHMMSS.json
+//
+// With encryption configured, chunk data is encrypted after compression.
+// Snapshot manifests (names, sizes, modes) stay readable locally; on
+// destinations they are sealed, see sealSnapshot.
+type repository struct {
+	root      string
+	enc       *config.Encryption
+	idKey     []byte // HMAC key of chunk ids with encryption, see chunkID
+	newChunks int
+	newBytes  int64
+	reused    int
+	// chunk and block are reused by storeFile for every file
+	chunk []byte
+	block []byte
+}
+
+// openRepository returns the repository below localPath, creating it if needed.
+func openRepository(localPath string, enc *config.Encryption) (*repository, error) {
+	root := filepath.Join(localPath, repositoryDirName)
+	for _, dir := range []string{"chunks", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create repository directory %s: %w", dir, err)
+		}
+	}
+	repo := &repository{root: root, enc: enc}
+	if enc != nil {
+		key, err := chunkIDKey(enc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive chunk id key: %w", err)
+		}
+		repo.idKey = key
+	}
+	return repo, nil
+}
+
+// chunkID returns the name a chunk is stored under: its SHA-256, or with
+// encryption its HMAC-SHA-256 keyed by idKey, so that the names do not reveal
+// which content a repository holds. Chunks stored under either kind of id are
+// read the same way.
+func (r *repository) chunkID(data []byte) string {
+	if r.idKey == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// snapshotDir returns the directory holding the snapshots of one item.
+func (r *repository) snapshotDir(category, name string) string {
+	return filepath.Join(r.root, "snapshots", category, name)
+}
+
+// chunkPath returns where the chunk with the given id is stored.
+func (r *repository) chunkPath(hash string) string {
+	return filepath.Join(r.root, "chunks", hash[:2], hash)
+}
+
+// backupTree stores baseDir/entryName in the repository and writes a snapshot
+// named <prefix>YYYYMMDD_HHMMSS.json for the item. It returns the snapshot path.
+func (r *repository) backupTree(category, name, prefix, baseDir, entryName string, filter *pathFilter) (string, error) {
+	snap := repoSnapshot{Source: filepath.Join(baseDir, entryName), Created: time.Now()}
+	links := make(map[fileID]string)
+
+	err := walkTree(baseDir, entryName, filter, func(fullPath, entry string) error {
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", fullPath, err)
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			fmt.Printf("⚠️ Skipping socket %s\n", fullPath)
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(fullPath); err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", fullPath, err)
+			}
+		}
+		// tar.FileInfoHeader gives us portable mode, ownership and times
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata of %s: %w", fullPath, err)
+		}
+
+		e := repoEntry{Name: entry, Mode: hdr.Mode, UID: hdr.Uid, GID: hdr.Gid, ModTime: hdr.ModTime.UnixNano()}
+		switch {
+		case info.IsDir():
+			e.Type = "dir"
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Type = "symlink"
+			e.Linkname = link
+		case info.Mode().IsRegular():
+			if id, ok := hardlinkID(info); ok {
+				if first, seen := links[id]; seen {
+					e.Type = "hardlink"
+					e.Linkname = first
+					break
+				}
+				links[id] = entry
+			}
+			e.Type = "file"
+			e.Size = info.Size()
+			if e.Chunks, err = r.storeFile(fullPath); err != nil {
+				return err
+			}
+		default:
+			fmt.Printf("⚠️ Skipping special file %s\n", fullPath)
+			return nil
+		}
+		snap.Entries = append(snap.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	dir := r.snapshotDir(category, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	snapPath := filepath.Join(dir, fmt.Sprintf("%s%s.json", prefix, snap.Created.Format(utils.TimestampLayout)))
+	if err := writeFileAtomic(snapPath, data); err != nil {
+		return "", err
+	}
+	return snapPath, nil
+}
+
+// storeFile splits a file into content-defined chunks, stores the ones not yet
+// in the repository and returns the list of chunk ids.
+func (r *repository) storeFile(fullPath string) ([]string, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", fullPath, err)
+	}
+	defer file.Close()
+
+	if r.chunk == nil {
+		r.chunk = make([]byte, 0, chunkMaxSize)
+		r.block = make([]byte, 1<<20)
+	}
+	var hashes []string
+	buf := r.chunk[:0]
+	var hash uint64
+
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		h, err := r.storeChunk(buf)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h)
+		buf = buf[:0]
+		hash = 0
+		return nil
+	}
+
+	for {
+		n, readErr := file.Read(r.block)
+		data := r.block[:n]
+		for len(data) > 0 {
+			// Find the next chunk boundary in data, if any
+			cut := -1
+			for i, b := range data {
+				hash = (hash << 1) + gearTable[b]
+				size := len(buf) + i + 1
+				if (size >= chunkMinSize && hash>>(64-chunkMaskBits) == 0) || size >= chunkMaxSize {
+					cut = i + 1
+					break
+				}
+			}
+			if cut < 0 {
+				buf = append(buf, data...)
+				break
+			}
+			buf = append(buf, data[:cut]...)
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			data = data[cut:]
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("error reading %s: %w", fullPath, readErr)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// storeChunk writes a chunk unless a chunk with the same id already exists.
+func (r *repository) storeChunk(data []byte) (string, error) {
+	hash := r.chunkID(data)
+	path := r.chunkPath(hash)
+
+	if _, err := os.Stat(path); err == nil {
+		r.reused++
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPattern(hash))
+	if err != nil {
+		return "", fmt.Errorf("failed to create chunk %s: %w", hash, err)
+	}
+	enc, err := encryptWriter(tmp, r.enc)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to set up encryption for chunk %s: %w", hash, err)
+	}
+	gz := gzip.NewWriter(enc)
+	_, err = gz.Write(data)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write chunk %s: %w", hash, err)
+	}
+
+	r.newChunks++
+	r.newBytes += int64(len(data))
+	return hash, nil
+}
+
+// restoreSnapshot recreates the entries of a snapshot below target. Unless force
+// is set, it refuses to run when a top-level entry already exists there.
+func (r *repository) restoreSnapshot(snapPath, target string, force bool) error {
+	snap, err := readSnapshot(snapPath, r.enc)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", target, err)
+	}
+
+	if !force {
+		for _, e := range snap.Entries {
+			if !strings.Contains(e.Name, "/") {
+				if _, err := os.Lstat(filepath.Join(target, e.Name)); err == nil {
+					return fmt.Errorf("%s already exists in %s (use --force to overwrite)", e.Name, target)
+				}
+			}
+		}
+	}
+
+	var dirs []repoEntry
+	for _, e := range snap.Entries {
+		// Reuse the tar extraction logic by presenting each entry as a tar header
+		hdr := &tar.Header{
+			Name:     e.Name,
+			Mode:     e.Mode,
+			Uid:      e.UID,
+			Gid:      e.GID,
+			ModTime:  time.Unix(0, e.ModTime),
+			Size:     e.Size,
+			Linkname: e.Linkname,
+		}
+		var content io.Reader = strings.NewReader("")
+		switch e.Type {
+		case "dir":
+			hdr.Typeflag = tar.TypeDir
+			dirs = append(dirs, e)
+		case "symlink":
+			hdr.Typeflag = tar.TypeSymlink
+		case "hardlink":
+			hdr.Typeflag = tar.TypeLink
+		case "file":
+			hdr.Typeflag = tar.TypeReg
+			content = &chunkReader{repo: r, chunks: e.Chunks}
+		default:
+			continue
+		}
+
+		dest, err := safeJoin(target, e.Name)
+		if err != nil {
+			return err
+		}
+		if err := extractEntry(content, hdr, target, dest); err != nil {
+			return err
+		}
+	}
+
+	// Directory times are applied last, since restoring their contents changes them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dest, err := safeJoin(target, dirs[i].Name); err == nil {
+			mtime := time.Unix(0, dirs[i].ModTime)
+			os.Chtimes(dest, mtime, mtime)
+		}
+	}
+	return nil
+}
+
+// chunkReader streams the content of a file from its chunks.
+type chunkReader struct {
+	repo    *repository
+	chunks  []string
+	current io.ReadCloser
+	file    *os.File
+}
+
+// Read implements io.Reader, opening the next chunk when the current one is exhausted.
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(c.repo.chunkPath(c.chunks[0]))
+			if err != nil {
+				return 0, fmt.Errorf("missing chunk %s: %w", c.chunks[0], err)
+			}
+			plain, err := decryptReader(file, c.repo.enc)
+			if err != nil {
+				file.Close()
+				return 0, fmt.Errorf("failed to decrypt chunk %s: %w", c.chunks[0], err)
+			}
+			gz, err := gzip.NewReader(plain)
+			if err != nil {
+				file.Close()
+				return 0, fmt.Errorf("corrupt chunk %s: %w", c.chunks[0], err)
+			}
+			c.file, c.current = file, gz
+			c.chunks = c.chunks[1:]
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.file.Close()
+			c.current, c.file = nil, nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// sealedSnapshot is a snapshot manifest as it is stored on destinations when
+// encryption is configured. Only the creation time stays readable; garbage
+// collection unseals the manifest to find the chunks it references.
+type sealedSnapshot struct {
+	Created time.Time `json:"created"`
+	Sealed  []byte    `json:"sealed"` // the manifest, encrypted like the chunks
+}
+
+// sealSnapshot returns the sealed form of the snapshot manifest data.
+func sealSnapshot(data []byte, enc *config.Encryption) ([]byte, error) {
+	var snap repoSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w, err := encryptWriter(&buf, enc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedSnapshot{Created: snap.Created, Sealed: buf.Bytes()})
+}
+
+// unsealSnapshot returns the manifest of a sealed snapshot, decrypted with
+// enc, and any other manifest unchanged.
+func unsealSnapshot(data []byte, enc *config.Encryption) ([]byte, error) {
+	var sealed sealedSnapshot
+	if err := json.Unmarshal(data, &sealed); err != nil || sealed.Sealed == nil {
+		return data, nil
+	}
+	r, err := decryptReader(bytes.NewReader(sealed.Sealed), enc)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// snapshotChunks returns the chunks a snapshot manifest references. Sealed
+// manifests are decrypted with enc.
+func snapshotChunks(data []byte, enc *config.Encryption) ([]string, error) {
+	data, err := unsealSnapshot(data, enc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	var snap struct {
+		Entries []repoEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var chunks []string
+	for _, e := range snap.Entries {
+		for _, h := range e.Chunks {
+			if !seen[h] {
+				seen[h] = true
+				chunks = append(chunks, h)
+			}
+		}
+	}
+	return chunks, nil
+}
+
+// readSnapshot loads a snapshot manifest. Sealed manifests, such as those
+// copied back from a destination, are decrypted with enc.
+func readSnapshot(snapPath string, enc *config.Encryption) (*repoSnapshot, error) {
+	data, err := os.ReadFile(snapPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", snapPath, err)
+	}
+	if data, err = unsealSnapshot(data, enc); err != nil {
+		return nil, fmt.Errorf("failed to decrypt snapshot %s: %w", snapPath, err)
+	}
+	var snap repoSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("error parsing snapshot %s: %w", snapPath, err)
+	}
+	return &snap, nil
+}
+
+// snapshotTime extracts the creation time from a snapshot file name.
+func snapshotTime(name string) (time.Time, bool) {
+	if !strings.HasSuffix(name, ".json") {
+		return time.Time{}, false
+	}
+	base := strings.TrimSuffix(name, ".json")
+	if len(base) < len(utils.TimestampLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(utils.TimestampLayout, base[len(base)-len(utils.TimestampLayout):], time.Local)
+	return t, err == nil
+}
+
+// listSnapshots returns the snapshots of one item as archive references.
+func (r *repository) listSnapshots(category, name string) ([]archiveRef, error) {
+	dir := r.snapshotDir(category, name)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+
+	var refs []archiveRef
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if t, ok := snapshotTime(entry.Name()); ok {
+			refs = append(refs, archiveRef{Name: entry.Name(), Time: t, Local: filepath.Join(dir, entry.Name())})
+		}
+	}
+	return refs, nil
+}
+
+// pruneSnapshots removes snapshots of an item that policy does not keep,
+// except the one named keep, and returns how many were removed. Chunks are
+// freed by collectGarbage.
+func (r *repository) pruneSnapshots(category, name string, policy retentionPolicy, keep string, mode cleanupMode) int {
+	refs, err := r.listSnapshots(category, name)
+	if err != nil {
+		fmt.Printf("⚠️ %v\n", err)
+		return 0
+	}
+
+	snapshots := make([]datedBackup, 0, len(refs))
+	for _, ref := range refs {
+		snap := datedBackup{Name: ref.Name, Time: ref.Time}
+		if info, err := os.Stat(ref.Local); err == nil {
+			snap.Size = info.Size()
+		}
+		snapshots = append(snapshots, snap)
+	}
+	sortNewestFirst(snapshots)
+	reasons, _, _ := planCleanup(snapshots, policy, nil, nil)
+	if keep != "" {
+		reasons[keep] = append(reasons[keep], "current")
+	}
+	if mode.explain {
+		printPlan("repository "+category+"/"+name, snapshots, reasons)
+	}
+
+	removed := 0
+	for _, ref := range refs {
+		if len(reasons[ref.Name]) > 0 {
+			continue
+		}
+		if mode.dryRun {
+			fmt.Printf("🗑️ Would delete old snapshot: %s/%s/%s\n", category, name, ref.Name)
+			continue
+		}
+		if err := os.Remove(ref.Local); err != nil {
+			fmt.Printf("❌ Failed to delete snapshot %s: %v\n", ref.Name, err)
+			continue
+		}
+		fmt.Printf("🗑️ Deleted old snapshot: %s/%s/%s\n", category, name, ref.Name)
+		removed++
+	}
+	return removed
+}
+
+// collectGarbage deletes chunks that no snapshot references any more.
+func (r *repository) collectGarbage() error {
+	referenced := make(map[string]bool)
+	err := filepath.WalkDir(filepath.Join(r.root, "snapshots"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		chunks, err := snapshotChunks(data, r.enc)
+		if err != nil {
+			return fmt.Errorf("error parsing snapshot %s: %w", path, err)
+		}
+		for _, h := range chunks {
+			referenced[h] = true
+		}
+		return nil
+	})
+	if err != nil {
+		// Never delete chunks based on an incomplete view of the snapshots
+		return fmt.Errorf("garbage collection aborted: %w", err)
+	}
+
+	var removed int
+	var freed int64
+	err = filepath.WalkDir(filepath.Join(r.root, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Chunks still being written are not referenced yet
+		if d.IsDir() || referenced[d.Name()] || isTempName(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			freed += info.Size()
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to delete chunk %s: %w", d.Name(), err)
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		fmt.Printf("🗑️ Repository garbage collection: removed %d unreferenced chunks (%d bytes)\n", removed, freed)
+	}
+	return err
+}
+
+// pruneRemoteSnapshots removes the snapshots in dir on dest that policy does
+// not keep, except the newest, and returns the paths of the removed ones (with
+// dryRun, of those that would be removed).
+func pruneRemoteSnapshots(dest Destination, dir string, policy retentionPolicy, mode cleanupMode) []string {
+	files, err := dest.List(dir)
+	if err != nil {
+		fmt.Printf("⚠️ %v\n", err)
+		return nil
+	}
+	var snapshots []datedBackup
+	for _, f := range files {
+		if t, ok := snapshotTime(f.Name); ok && !f.IsDir {
+			snapshots = append(snapshots, datedBackup{Name: f.Name, Time: t, Size: f.Size})
+		}
+	}
+	if len(snapshots) == 0 {
+		return nil
+	}
+	sortNewestFirst(snapshots)
+	reasons, _, _ := planCleanup(snapshots, policy, nil, nil)
+	reasons[snapshots[0].Name] = append(reasons[snapshots[0].Name], "newest")
+	if mode.explain {
+		printPlan(dir+" on "+dest.Name(), snapshots, reasons)
+	}
+
+	var removed []string
+	for _, snap := range snapshots {
+		if len(reasons[snap.Name]) > 0 {
+			continue
+		}
+		fullPath := dir + "/" + snap.Name
+		if mode.dryRun {
+			fmt.Printf("🗑️ Would delete old snapshot on %s: %s\n", dest.Name(), fullPath)
+		} else if err := dest.Delete(fullPath); err != nil {
+			fmt.Printf("⚠️ Failed to delete %s on %s: %v\n", fullPath, dest.Name(), err)
+			continue
+		} else {
+			fmt.Printf("🗑️ Deleted old snapshot on %s: %s\n", dest.Name(), fullPath)
+		}
+		removed = append(removed, fullPath)
+	}
+	return removed
+}
+
+// collectRemoteGarbage deletes the chunks on dest that no snapshot there
+// references, ignoring the snapshots in removed (already deleted, or to be
+// deleted in a dry run). Sealed snapshots are decrypted with enc; if one
+// cannot be, no chunk is deleted.
+func collectRemoteGarbage(dest Destination, removed map[string]bool, enc *config.Encryption, mode cleanupMode) error {
+	referenced := make(map[string]bool)
+	var readSnapshots func(dir string) error
+	readSnapshots = func(dir string) error {
+		files, err := dest.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			p := dir + "/" + f.Name
+			if f.IsDir {
+				if err := readSnapshots(p); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := snapshotTime(f.Name); !ok || removed[p] {
+				continue
+			}
+			r, err := dest.Get(p)
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read snapshot %s: %w", p, err)
+			}
+			chunks, err := snapshotChunks(data, enc)
+			if err != nil {
+				return fmt.Errorf("error parsing snapshot %s: %w", p, err)
+			}
+			for _, h := range chunks {
+				referenced[h] = true
+			}
+		}
+		return nil
+	}
+	if err := readSnapshots(repositoryDirName + "/snapshots"); err != nil {
+		// Never delete chunks based on an incomplete view of the snapshots
+		return fmt.Errorf("garbage collection on %s aborted: %w", dest.Name(), err)
+	}
+
+	var removedChunks int
+	var freed int64
+	chunkDir := repositoryDirName + "/chunks"
+	prefixes, err := dest.List(chunkDir)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir {
+			continue
+		}
+		chunks, err := dest.List(chunkDir + "/" + prefix.Name)
+		if err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			// Dot files are uploads in progress
+			if c.IsDir || strings.HasPrefix(c.Name, ".") || referenced[c.Name] {
+				continue
+			}
+			if !mode.dryRun {
+				if err := dest.Delete(chunkDir + "/" + prefix.Name + "/" + c.Name); err != nil {
+					return fmt.Errorf("failed to delete chunk %s on %s: %w", c.Name, dest.Name(), err)
+				}
+			}
+			removedChunks++
+			freed += c.Size
+		}
+	}
+	if removedChunks > 0 && mode.dryRun {
+		fmt.Printf("🗑️ Repository garbage collection on %s would remove %d unreferenced chunks (%d bytes)\n", dest.Name(), removedChunks, freed)
+	} else if removedChunks > 0 {
+		fmt.Printf("🗑️ Repository garbage collection on %s: removed %d unreferenced chunks (%d bytes)\n", dest.Name(), removedChunks, freed)
+	}
+	return nil
+}
+
+// backupToRepository stores an item in the repository, applies its retention
+// and frees unreferenced chunks. It returns the snapshot path.
+func backupToRepository(localPath, category, name, prefix, baseDir, entryName string, policy retentionPolicy, filter *pathFilter, opts ArchiveOptions) (string, error) {
+	repo, err := openRepository(localPath, opts.Encryption)
+	if err != nil {
+		return "", err
+	}
+	snapPath, err := repo.backupTree(category, name, prefix, baseDir, entryName, filter)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("ℹ️ Repository: %d new chunks (%d bytes), %d reused\n", repo.newChunks, repo.newBytes, repo.reused)
+
+	if repo.pruneSnapshots(category, name, policy, filepath.Base(snapPath), cleanupMode{}) > 0 {
+		if err := repo.collectGarbage(); err != nil {
+			fmt.Printf("⚠️ %v\n", err)
+		}
+	}
+	return snapPath, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPattern(filepath.Base(path)))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+	"backup-tool/utils"
+)
+
+// kindLayout maps a restore kind to the category directory and archive prefix
+// used by BackupDirs, BackupFiles and BackupLogs.
+var kindLayout = map[string]struct {
+	Category string
+	Prefix   string
+}{
+	"dir":  {Category: "dirs", Prefix: "dir_"},
+	"file": {Category: "files", Prefix: "file_"},
+	"log":  {Category: "logs", Prefix: "log_"},
+}
+
+// RestoreOptions describes which archive to restore and where to extract it.
+type RestoreOptions struct {
+	Kind   string    // dir, file or log
+	Name   string    // item name, i.e. the backup subdirectory
+	At     time.Time // the newest archive taken at or before this time is used
+	Target string    // directory the archive is extracted into
+	Force  bool      // overwrite entries that already exist in Target
+	// Encryption holds the keys for encrypted archives and repository chunks
+	Encryption *config.Encryption
+}
+
+// archiveRef points to an archive either in the local backup tree or on a destination.
+type archiveRef struct {
+	Name   string
+	Time   time.Time
+	Local  string // full local path, empty if the archive only exists remotely
+	Remote string // path on the destination, empty if not looked up remotely
+	Dest   string // name of the destination holding Remote
+}
+
+// RestoreArchive extracts the newest dir/file/log archive taken at or before
+// opts.At into opts.Target. Incremental and differential archives are replayed
+// on top of the full backup they depend on. Archives no longer present locally
+// are downloaded from the first destination in dests that has them.
+func RestoreArchive(localPath string, dests []config.Destination, opts RestoreOptions) error {
+	layout, ok := kindLayout[opts.Kind]
+	if !ok {
+		return fmt.Errorf("unsupported kind %q (expected dir, file or log)", opts.Kind)
+	}
+	if opts.Name == "" {
+		return fmt.Errorf("backup name is required")
+	}
+	if opts.Target == "" {
+		return fmt.Errorf("restore target is required")
+	}
+
+	candidates, err := listArchives(localPath, dests, layout.Category, opts.Name, layout.Prefix)
+	if err != nil {
+		return err
+	}
+	repo := &repository{root: filepath.Join(localPath, repositoryDirName), enc: opts.Encryption}
+	snapshots, err := repo.listSnapshots(layout.Category, opts.Name)
+	if err != nil {
+		return err
+	}
+	all := append(append([]archiveRef{}, candidates...), snapshots...)
+	ref, ok := pickArchive(all, opts.At)
+	if !ok {
+		return fmt.Errorf("no %s archive for %s at or before %s", opts.Kind, opts.Name, opts.At.Format("2006-01-02 15:04:05"))
+	}
+
+	if _, isSnapshot := snapshotTime(ref.Name); isSnapshot {
+		fmt.Printf("📦 Restoring snapshot %s (%s) → %s\n", ref.Name, ref.Time.Format("2006-01-02 15:04:05"), opts.Target)
+		if err := repo.restoreSnapshot(ref.Local, opts.Target, opts.Force); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Restored %s into %s\n", ref.Name, opts.Target)
+		return nil
+	}
+
+	// Resolve the chain of incremental/differential archives back to a full backup
+	byName := make(map[string]archiveRef, len(candidates))
+	for _, c := range candidates {
+		byName[c.Name] = c
+	}
+	var chain []string // local paths, oldest first
+	for current := ref; ; {
+		archivePath, cleanup, err := fetchArchive(dests, current)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		chain = append([]string{archivePath}, chain...)
+
+		manifest, err := readManifest(archivePath, opts.Encryption)
+		if err != nil {
+			return err
+		}
+		if manifest.Base == "" {
+			break
+		}
+		base, ok := byName[manifest.Base]
+		if !ok {
+			return fmt.Errorf("%s is %s against %s, which no longer exists", current.Name, manifest.Type, manifest.Base)
+		}
+		current = base
+	}
+
+	if len(chain) > 1 {
+		fmt.Printf("📦 Restoring %s (%s) → %s, replaying %d archives\n", ref.Name, ref.Time.Format("2006-01-02 15:04:05"), opts.Target, len(chain))
+	} else {
+		fmt.Printf("📦 Restoring %s (%s) → %s\n", ref.Name, ref.Time.Format("2006-01-02 15:04:05"), opts.Target)
+	}
+	for i, archivePath := range chain {
+		// Only the first archive may refuse to overwrite; the rest replay changes on top
+		if err := extractArchive(archivePath, opts.Target, opts.Force || i > 0, opts.Encryption); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("✅ Restored %s into %s\n", ref.Name, opts.Target)
+	return nil
+}
+
+// findArchive returns the newest archive in <category>/<name> taken at or before at,
+// looking on the destinations as well.
+func findArchive(localPath string, dests []config.Destination, category, name, prefix string, at time.Time) (archiveRef, error) {
+	candidates, err := listArchives(localPath, dests, category, name, prefix)
+	if err != nil {
+		return archiveRef{}, err
+	}
+	ref, ok := pickArchive(candidates, at)
+	if !ok {
+		return archiveRef{}, fmt.Errorf("no archive for %s/%s at or before %s", category, name, at.Format("2006-01-02 15:04:05"))
+	}
+	return ref, nil
+}
+
+// listArchives returns the archives in <category>/<name>, locally and on
+// every destination.
+func listArchives(localPath string, dests []config.Destination, category, name, prefix string) ([]archiveRef, error) {
+	candidates, err := listLocalArchives(filepath.Join(localPath, category, name), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cfg := range dests {
+		remote, err := listRemoteArchives(cfg, category+"/"+name, prefix)
+		if err != nil {
+			fmt.Printf("⚠️ Could not list archives on %s: %v\n", cfg.Name, err)
+		}
+		candidates = mergeArchiveRefs(candidates, remote)
+	}
+	return candidates, nil
+}
+
+// fetchArchive makes sure ref is available on the local disk. It returns the path
+// of the local copy and a function that removes it again if it had to be downloaded.
+func fetchArchive(dests []config.Destination, ref archiveRef) (string, func(), error) {
+	if ref.Local != "" {
+		return ref.Local, func() {}, nil
+	}
+
+	for _, cfg := range dests {
+		if cfg.Name != ref.Dest {
+			continue
+		}
+		tmp, err := downloadFromDestination(cfg, ref.Remote)
+		if err != nil {
+			return "", nil, err
+		}
+		return tmp, func() { os.Remove(tmp) }, nil
+	}
+	return "", nil, fmt.Errorf("destination %s of %s is not configured", ref.Dest, ref.Name)
+}
+
+// listLocalArchives returns all archives with the given prefix in dir.
+// A missing directory is not an error: the backups may only exist remotely.
+func listLocalArchives(dir, prefix string) ([]archiveRef, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+
+	var refs []archiveRef
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, ok := utils.GetBackupTimeFromName(name)
+		if !ok {
+			continue
+		}
+		refs = append(refs, archiveRef{Name: name, Time: t, Local: filepath.Join(dir, name)})
+	}
+	return refs, nil
+}
+
+// listRemoteArchives returns all archives with the given prefix in remoteDir on a destination.
+func listRemoteArchives(cfg config.Destination, remoteDir, prefix string) ([]archiveRef, error) {
+	dest, err := OpenDestination(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+
+	files, err := dest.List(remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []archiveRef
+	for _, fi := range files {
+		name := fi.Name
+		if fi.IsDir || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, ok := utils.GetBackupTimeFromName(name)
+		if !ok {
+			continue
+		}
+		refs = append(refs, archiveRef{Name: name, Time: t, Remote: remoteDir + "/" + name, Dest: dest.Name()})
+	}
+	return refs, nil
+}
+
+// mergeArchiveRefs combines local and remote listings, preferring local copies
+// and, for remote ones, the destination merged first.
+func mergeArchiveRefs(local, remote []archiveRef) []archiveRef {
+	byName := make(map[string]int, len(local))
+	for i, ref := range local {
+		byName[ref.Name] = i
+	}
+	for _, ref := range remote {
+		if i, ok := byName[ref.Name]; ok {
+			if local[i].Remote == "" {
+				local[i].Remote, local[i].Dest = ref.Remote, ref.Dest
+			}
+			continue
+		}
+		byName[ref.Name] = len(local)
+		local = append(local, ref)
+	}
+	return local
+}
+
+// pickArchive returns the newest archive taken at or before at.
+func pickArchive(refs []archiveRef, at time.Time) (archiveRef, bool) {
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Time.Before(refs[j].Time) })
+	for i := len(refs) - 1; i >= 0; i-- {
+		if !refs[i].Time.After(at) {
+			return refs[i], true
+		}
+	}
+	return archiveRef{}, false
+}
+
+// downloadFromDestination copies a remote archive into a temporary local file and returns its path.
+func downloadFromDestination(cfg config.Destination, remotePath string) (string, error) {
+	dest, err := OpenDestination(cfg)
+	if err != nil {
+		return "", err
+	}
+	defer dest.Close()
+
+	src, err := dest.Get(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "restore-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	fmt.Printf("📥 Downloading %s from %s...\n", remotePath, dest.Name())
+	written, err := io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("error downloading %s from %s: %w", remotePath, dest.Name(), err)
+	}
+
+	fmt.Printf("✅ Downloaded: %s (%d bytes)\n", remotePath, written)
+	return tmp.Name(), nil
+}
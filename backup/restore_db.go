@@ -0,0 +1,223 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+)
+
+// DBRestoreOptions controls how a database archive is restored.
+type DBRestoreOptions struct {
+	At     time.Time // the newest archive taken at or before this time is used
+	Into   string    // name of the database to restore into (default: the original name)
+	Drop   bool      // drop and recreate the target database before restoring
+	DryRun bool      // only print the commands that would be run
+	// Encryption holds the keys for encrypted archives
+	Encryption *config.Encryption
+}
+
+// dbCommand is an external command used during a database restore.
+type dbCommand struct {
+	Name  string
+	Args  []string
+	Env   []string
+	Stdin string // file fed to the command's standard input
+}
+
+// String renders the command for display with the password masked.
+func (c dbCommand) String(password string) string {
+	mask := func(s string) string {
+		if password == "" {
+			return s
+		}
+		return strings.ReplaceAll(s, password, "****")
+	}
+
+	var parts []string
+	for _, env := range c.Env {
+		parts = append(parts, mask(env))
+	}
+	parts = append(parts, c.Name)
+	for _, arg := range c.Args {
+		quote := strings.ContainsAny(arg, " `\"'*;")
+		arg = mask(arg)
+		if quote {
+			arg = fmt.Sprintf("%q", arg)
+		}
+		parts = append(parts, arg)
+	}
+	if c.Stdin != "" {
+		parts = append(parts, "<", c.Stdin)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Run executes the command, returning its combined output on failure.
+func (c dbCommand) Run() error {
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	if c.Stdin != "" {
+		in, err := os.Open(c.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", c.Stdin, err)
+		}
+		defer in.Close()
+		cmd.Stdin = in
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s error: %w, output: %s", c.Name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// RestoreDatabase restores the newest db_* archive of db taken at or before
+// opts.At using pg_restore, mysql or mongorestore with the connection profile user.
+func RestoreDatabase(localPath string, dests []config.Destination, db config.Database, user config.DBUser, opts DBRestoreOptions) error {
+	target := db.Name
+	if opts.Into != "" {
+		target = opts.Into
+	}
+
+	ref, err := findArchive(localPath, dests, "databases", db.Name, "db_", opts.At)
+	if err != nil {
+		return err
+	}
+
+	workDir := "<tempdir>"
+	archivePath := ref.Local
+	if !opts.DryRun {
+		path, cleanup, err := fetchArchive(dests, ref)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		archivePath = path
+
+		workDir, err = os.MkdirTemp("", "dbrestore-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(workDir)
+	} else if archivePath == "" {
+		archivePath = ref.Dest + ":" + ref.Remote
+	}
+
+	commands, err := dbRestoreCommands(db, user, target, workDir, opts.Drop)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Printf("ℹ️ Dry run: restoring %s from %s into %s would run:\n", db.Name, ref.Name, target)
+		fmt.Printf("   extract %s (%s) into %s\n", archivePath, archiveFormat(ref.Name), workDir)
+		for _, c := range commands {
+			fmt.Printf("   %s\n", c.String(user.Password.Value))
+		}
+		return nil
+	}
+
+	fmt.Printf("📦 Restoring database %s from %s into %s\n", db.Name, ref.Name, target)
+	if err := extractArchive(archivePath, workDir, true, opts.Encryption); err != nil {
+		return fmt.Errorf("error unpacking %s: %w", ref.Name, err)
+	}
+
+	for _, c := range commands {
+		fmt.Printf("▶️ %s\n", c.String(user.Password.Value))
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("restore of %s into %s failed: %w", db.Name, target, err)
+		}
+	}
+
+	fmt.Printf("✅ Database %s restored into %s\n", db.Name, target)
+	return nil
+}
+
+// archiveFormat describes the compression and encryption of an archive by its
+// name, e.g. "zstd, age".
+func archiveFormat(name string) string {
+	encryption := ""
+	if base, ok := strings.CutSuffix(name, ".age"); ok {
+		name, encryption = base, ", "+EncryptionAge
+	} else if base, ok := strings.CutSuffix(name, ".enc"); ok {
+		name, encryption = base, ", "+EncryptionPassphrase
+	}
+	compression := CompressionNone
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		compression = CompressionGzip
+	case strings.HasSuffix(name, ".tar.zst"):
+		compression = CompressionZstd
+	case strings.HasSuffix(name, ".tar.xz"):
+		compression = CompressionXz
+	}
+	return compression + encryption
+}
+
+// dbRestoreCommands builds the commands that restore a dump unpacked into workDir
+// into the database target. The dump layout matches what BackupDatabases produces.
+func dbRestoreCommands(db config.Database, user config.DBUser, target, workDir string, drop bool) ([]dbCommand, error) {
+	var commands []dbCommand
+
+	switch strings.ToLower(db.Type) {
+	case "postgres":
+		conn := []string{"-h", user.Host, "-p", fmt.Sprint(user.Port), "-U", user.User}
+		env := []string{fmt.Sprintf("PGPASSWORD=%s", user.Password.Value)}
+		if drop {
+			commands = append(commands,
+				dbCommand{Name: "dropdb", Args: append(append([]string{}, conn...), "--if-exists", target), Env: env},
+				dbCommand{Name: "createdb", Args: append(append([]string{}, conn...), target), Env: env},
+			)
+		}
+		commands = append(commands, dbCommand{
+			Name: "pg_restore",
+			Args: append(append([]string{}, conn...), "-d", target, "--no-owner", "-F", "t", filepath.Join(workDir, "dump.tar")),
+			Env:  env,
+		})
+
+	case "mysql":
+		conn := []string{"-h", user.Host, "-P", fmt.Sprint(user.Port), "-u", user.User, "--password=" + user.Password.Value}
+		if drop {
+			// Backticks are doubled so the name cannot end the quoted identifier
+			ident := "`" + strings.ReplaceAll(target, "`", "``") + "`"
+			commands = append(commands, dbCommand{
+				Name: "mysql",
+				Args: append(append([]string{}, conn...), "-e", fmt.Sprintf("DROP DATABASE IF EXISTS %s; CREATE DATABASE %s", ident, ident)),
+			})
+		}
+		commands = append(commands, dbCommand{
+			Name:  "mysql",
+			Args:  append(append([]string{}, conn...), "--database="+target),
+			Stdin: filepath.Join(workDir, "dump.sql"),
+		})
+
+	case "mongo":
+		args := []string{"--host", fmt.Sprintf("%s:%d", user.Host, user.Port)}
+		if user.User != "" {
+			args = append(args, "--username", user.User)
+			if user.Password.Value != "" {
+				args = append(args, "--password", user.Password.Value)
+			}
+		}
+		args = append(args, "--nsInclude", db.Name+".*")
+		if target != db.Name {
+			args = append(args, "--nsFrom", db.Name+".*", "--nsTo", target+".*")
+		}
+		if drop {
+			args = append(args, "--drop")
+		}
+		args = append(args, filepath.Join(workDir, "dump"))
+		commands = append(commands, dbCommand{Name: "mongorestore", Args: args})
+
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", db.Type)
+	}
+
+	return commands, nil
+}
@@ -0,0 +1,41 @@
+// Package backup
+package backup
+
+import (
+	"reflect"
+	"testing"
+
+	"backup-tool/config"
+)
+
+func TestDBRestoreCommandsQuotesMySQLName(t *testing.T) {
+	db := config.Database{Name: "app", Type: "mysql"}
+	user := config.DBUser{Host: "localhost", Port: 3306, User: "root"}
+
+	tests := []struct {
+		target  string
+		wantSQL string
+	}{
+		{target: "app_copy", wantSQL: "DROP DATABASE IF EXISTS `app_copy`; CREATE DATABASE `app_copy`"},
+		{target: "x`; DROP DATABASE app; --", wantSQL: "DROP DATABASE IF EXISTS `x``; DROP DATABASE app; --`; CREATE DATABASE `x``; DROP DATABASE app; --`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			commands, err := dbRestoreCommands(db, user, tt.target, "/work", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(commands) != 2 {
+				t.Fatalf("got %d commands, want 2", len(commands))
+			}
+			drop := commands[0].Args
+			if got := drop[len(drop)-2:]; !reflect.DeepEqual(got, []string{"-e", tt.wantSQL}) {
+				t.Errorf("drop command ends with %q, want -e %q", got, tt.wantSQL)
+			}
+			restore := commands[1].Args
+			if got, want := restore[len(restore)-1], "--database="+tt.target; got != want {
+				t.Errorf("restore command ends with %q, want %q", got, want)
+			}
+		})
+	}
+}
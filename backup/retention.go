@@ -0,0 +1,200 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+	"backup-tool/utils"
+)
+
+// defaultMinKeep is the number of backups retention never deletes unless an
+// item sets minKeep.
+const defaultMinKeep = 3
+
+// retentionPolicy decides which backups of an item are kept: those younger
+// than Lifetime days and those selected by the keep rules, and never fewer
+// than MinKeep verified backups.
+type retentionPolicy struct {
+	Lifetime int
+	Keep     config.Keep
+	MinKeep  int
+}
+
+// minKeepOf returns the configured minKeep, or the default if it is not set.
+func minKeepOf(minKeep *int) int {
+	if minKeep == nil {
+		return defaultMinKeep
+	}
+	return *minKeep
+}
+
+// itemPolicy returns the local retention of a dir, file or log item.
+func itemPolicy(item config.Item) retentionPolicy {
+	return retentionPolicy{Lifetime: item.Lifetime, Keep: item.Keep, MinKeep: minKeepOf(item.MinKeep)}
+}
+
+// databasePolicy returns the local retention of a database.
+func databasePolicy(db config.Database) retentionPolicy {
+	return retentionPolicy{Lifetime: db.Lifetime, Keep: db.Keep, MinKeep: minKeepOf(db.MinKeep)}
+}
+
+// cleanupMode controls how a cleanup reports and applies its decisions.
+type cleanupMode struct {
+	dryRun  bool // only report what would be deleted
+	explain bool // print every backup with the rules that keep it
+}
+
+// datedBackup is a backup with the time parsed from its name.
+type datedBackup struct {
+	Name string
+	Time time.Time
+	Size int64 // empty archives are incomplete and never count for minKeep
+}
+
+// datedBackups returns the archives among files that start with prefix,
+// newest first.
+func datedBackups(files []RemoteFile, prefix string) []datedBackup {
+	var backups []datedBackup
+	for _, f := range files {
+		name := f.Name
+		if f.IsDir || !strings.HasPrefix(name, prefix) || !utils.IsArchiveName(name) {
+			continue
+		}
+		t, ok := utils.GetBackupTimeFromName(name)
+		if !ok {
+			fmt.Printf("⚠️ Failed to determine backup time from filename: %s (skipping)\n", name)
+			continue
+		}
+		backups = append(backups, datedBackup{Name: name, Time: t, Size: f.Size})
+	}
+	sortNewestFirst(backups)
+	return backups
+}
+
+// sortNewestFirst orders backups by time, newest first.
+func sortNewestFirst(backups []datedBackup) {
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+}
+
+// keepReasons returns, by name, the rules that keep each backup. backups must
+// be sorted newest first; backups missing from the result have expired.
+func (p retentionPolicy) keepReasons(backups []datedBackup, now time.Time) map[string][]string {
+	reasons := make(map[string][]string)
+
+	if p.Lifetime > 0 {
+		cutoff := now.AddDate(0, 0, -p.Lifetime)
+		rule := fmt.Sprintf("within %d days", p.Lifetime)
+		for _, b := range backups {
+			if !b.Time.Before(cutoff) {
+				reasons[b.Name] = append(reasons[b.Name], rule)
+			}
+		}
+	}
+
+	for i := 0; i < p.Keep.Last && i < len(backups); i++ {
+		reasons[backups[i].Name] = append(reasons[backups[i].Name], "last")
+	}
+
+	// Each bucket rule keeps the newest backup of each of its newest periods
+	buckets := []struct {
+		rule  string
+		count int
+		key   func(time.Time) string
+	}{
+		{"daily", p.Keep.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Keep.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.Keep.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Keep.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, bucket := range buckets {
+		last := ""
+		remaining := bucket.count
+		for _, b := range backups {
+			if remaining == 0 {
+				break
+			}
+			if key := bucket.key(b.Time); key != last {
+				last = key
+				reasons[b.Name] = append(reasons[b.Name], bucket.rule)
+				remaining--
+			}
+		}
+	}
+	return reasons
+}
+
+// planCleanup applies policy to backups (sorted newest first) and returns the
+// rules keeping each backup and the expired backups to delete. Expired
+// backups that kept backups depend on (see chainBases) are kept as well and
+// returned as protected. verify decides which backups count for minKeep; it
+// is only called until MinKeep backups are found (nil counts every non-empty
+// backup).
+func planCleanup(backups []datedBackup, policy retentionPolicy, baseOf func(name string) string, verify func(datedBackup) bool) (reasons map[string][]string, expired, protected []datedBackup) {
+	reasons = policy.keepReasons(backups, time.Now())
+
+	// Never go below MinKeep verified backups, e.g. when backups have been
+	// failing for longer than the lifetime. Kept backups count first.
+	verified := func(b datedBackup) bool {
+		return b.Size > 0 && (verify == nil || verify(b))
+	}
+	count := 0
+	for _, b := range backups {
+		if count >= policy.MinKeep {
+			break
+		}
+		if len(reasons[b.Name]) > 0 && verified(b) {
+			count++
+		}
+	}
+	for _, b := range backups {
+		if count >= policy.MinKeep {
+			break
+		}
+		if len(reasons[b.Name]) == 0 && verified(b) {
+			reasons[b.Name] = []string{fmt.Sprintf("minKeep %d", policy.MinKeep)}
+			count++
+		}
+	}
+
+	var kept []string
+	for _, b := range backups {
+		if len(reasons[b.Name]) > 0 {
+			kept = append(kept, b.Name)
+		}
+	}
+	var bases map[string]bool
+	if baseOf != nil {
+		bases = chainBases(kept, baseOf)
+	}
+
+	for _, b := range backups {
+		switch {
+		case len(reasons[b.Name]) > 0:
+		case bases[b.Name]:
+			reasons[b.Name] = []string{"newer backups depend on it"}
+			protected = append(protected, b)
+		default:
+			expired = append(expired, b)
+		}
+	}
+	return reasons, expired, protected
+}
+
+// printPlan lists every backup of where with the rules that keep it.
+func printPlan(where string, backups []datedBackup, reasons map[string][]string) {
+	fmt.Printf("🔎 %s: %d backups\n", where, len(backups))
+	for _, b := range backups {
+		if r := reasons[b.Name]; len(r) > 0 {
+			fmt.Printf("   keep   %s (%s)\n", b.Name, strings.Join(r, ", "))
+		} else {
+			fmt.Printf("   delete %s\n", b.Name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Package backup
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"backup-tool/config"
+)
+
+func TestPlanCleanupMinKeepCountsVerifiedBackups(t *testing.T) {
+	now := time.Now()
+	backup := func(name string, daysAgo int, size int64) datedBackup {
+		return datedBackup{Name: name, Time: now.AddDate(0, 0, -daysAgo), Size: size}
+	}
+	// All expired, newest first; "corrupt" fails verification, "empty" is empty
+	backups := []datedBackup{
+		backup("corrupt", 10, 100),
+		backup("empty", 11, 0),
+		backup("b", 12, 100),
+		backup("c", 13, 100),
+		backup("d", 14, 100),
+	}
+	var checked []string
+	verify := func(b datedBackup) bool {
+		checked = append(checked, b.Name)
+		return b.Name != "corrupt"
+	}
+
+	reasons, expired, _ := planCleanup(backups, retentionPolicy{Lifetime: 1, MinKeep: 2}, nil, verify)
+	var kept, deleted []string
+	for _, b := range backups {
+		if len(reasons[b.Name]) > 0 {
+			kept = append(kept, b.Name)
+		}
+	}
+	for _, b := range expired {
+		deleted = append(deleted, b.Name)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+	if want := []string{"corrupt", "empty", "d"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+	// Verification stops once minKeep backups are found, and empty archives
+	// are not opened
+	if want := []string{"corrupt", "b", "c"}; !reflect.DeepEqual(checked, want) {
+		t.Errorf("verified %v, want %v", checked, want)
+	}
+}
+
+// at returns a fixed UTC time for the retention tests.
+func at(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+}
+
+// rolloverBackups spans the ISO week and year boundaries at the end of 2025:
+// 2025-12-29 is in ISO week 2026-W01 but in calendar year 2025, and
+// 2025-12-28 is the last day of 2025-W52. Newest first.
+var rolloverBackups = []datedBackup{
+	{Name: "2026-01-05", Time: at(2026, time.January, 5, 1), Size: 100},    // Mon, 2026-W02
+	{Name: "2026-01-04", Time: at(2026, time.January, 4, 1), Size: 100},    // Sun, 2026-W01
+	{Name: "2026-01-01", Time: at(2026, time.January, 1, 1), Size: 100},    // Thu, 2026-W01
+	{Name: "2025-12-29", Time: at(2025, time.December, 29, 1), Size: 100},  // Mon, 2026-W01
+	{Name: "2025-12-28", Time: at(2025, time.December, 28, 23), Size: 100}, // Sun, 2025-W52
+}
+
+func TestKeepReasons(t *testing.T) {
+	now := at(2026, time.January, 6, 12)
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		want   map[string][]string
+	}{
+		{
+			name:   "last",
+			policy: retentionPolicy{Keep: config.Keep{Last: 2}},
+			want:   map[string][]string{"2026-01-05": {"last"}, "2026-01-04": {"last"}},
+		},
+		{
+			name:   "daily",
+			policy: retentionPolicy{Keep: config.Keep{Daily: 3}},
+			want:   map[string][]string{"2026-01-05": {"daily"}, "2026-01-04": {"daily"}, "2026-01-01": {"daily"}},
+		},
+		{
+			name:   "weekly across the ISO year boundary",
+			policy: retentionPolicy{Keep: config.Keep{Weekly: 3}},
+			want:   map[string][]string{"2026-01-05": {"weekly"}, "2026-01-04": {"weekly"}, "2025-12-28": {"weekly"}},
+		},
+		{
+			name:   "monthly",
+			policy: retentionPolicy{Keep: config.Keep{Monthly: 2}},
+			want:   map[string][]string{"2026-01-05": {"monthly"}, "2025-12-29": {"monthly"}},
+		},
+		{
+			name:   "yearly uses the calendar year",
+			policy: retentionPolicy{Keep: config.Keep{Yearly: 5}},
+			want:   map[string][]string{"2026-01-05": {"yearly"}, "2025-12-29": {"yearly"}},
+		},
+		{
+			name:   "lifetime",
+			policy: retentionPolicy{Lifetime: 3},
+			want:   map[string][]string{"2026-01-05": {"within 3 days"}, "2026-01-04": {"within 3 days"}},
+		},
+		{
+			name:   "lifetime with keep rules",
+			policy: retentionPolicy{Lifetime: 2, Keep: config.Keep{Last: 1, Weekly: 2, Yearly: 1}},
+			want: map[string][]string{
+				"2026-01-05": {"within 2 days", "last", "weekly", "yearly"},
+				"2026-01-04": {"weekly"},
+			},
+		},
+		{
+			name:   "nothing configured",
+			policy: retentionPolicy{},
+			want:   map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.keepReasons(rolloverBackups, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keepReasons = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanCleanupProtectsChainBases(t *testing.T) {
+	// 2025-12-28 and 2026-01-04 are full backups; each other backup is
+	// incremental on the one before it
+	bases := map[string]string{
+		"2026-01-05": "2026-01-04",
+		"2026-01-01": "2025-12-29",
+		"2025-12-29": "2025-12-28",
+	}
+	baseOf := func(name string) string { return bases[name] }
+
+	tests := []struct {
+		name          string
+		policy        retentionPolicy
+		wantProtected []string
+		wantExpired   []string
+	}{
+		{
+			name:          "newest incremental keeps its full backup",
+			policy:        retentionPolicy{Keep: config.Keep{Last: 1}},
+			wantProtected: []string{"2026-01-04"},
+			wantExpired:   []string{"2026-01-01", "2025-12-29", "2025-12-28"},
+		},
+		{
+			name:          "kept incremental keeps its whole chain",
+			policy:        retentionPolicy{Keep: config.Keep{Monthly: 2}},
+			wantProtected: []string{"2026-01-04", "2025-12-28"},
+			wantExpired:   []string{"2026-01-01"},
+		},
+		{
+			name:          "backups kept by minKeep keep their chains",
+			policy:        retentionPolicy{Keep: config.Keep{Last: 1}, MinKeep: 3},
+			wantProtected: []string{"2025-12-29", "2025-12-28"},
+		},
+		{
+			name:        "kept bases are not reported as protected",
+			policy:      retentionPolicy{Keep: config.Keep{Daily: 2}},
+			wantExpired: []string{"2026-01-01", "2025-12-29", "2025-12-28"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, expired, protected := planCleanup(rolloverBackups, tt.policy, baseOf, nil)
+			if got := backupNames(protected); !reflect.DeepEqual(got, tt.wantProtected) {
+				t.Errorf("protected %v, want %v", got, tt.wantProtected)
+			}
+			if got := backupNames(expired); !reflect.DeepEqual(got, tt.wantExpired) {
+				t.Errorf("expired %v, want %v", got, tt.wantExpired)
+			}
+		})
+	}
+}
+
+// backupNames returns the names of backups.
+func backupNames(backups []datedBackup) []string {
+	var names []string
+	for _, b := range backups {
+		names = append(names, b.Name)
+	}
+	return names
+}
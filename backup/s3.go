@@ -0,0 +1,200 @@
+// Package backup
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"backup-tool/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// defaultS3PartSize is the multipart part size in MiB if none is configured.
+const defaultS3PartSize = 64
+
+// s3Destination stores backups as objects in an S3 bucket. Directories are
+// key prefixes, so they need not be created and disappear with their last object.
+type s3Destination struct {
+	name   string
+	client *minio.Client
+	cfg    config.S3Destination
+	verify bool // read uploads back and compare their SHA-256
+}
+
+// openS3Destination creates a client for the bucket described by cfg and
+// checks that the bucket exists.
+func openS3Destination(name string, cfg config.S3Destination, verify bool) (*s3Destination, error) {
+	endpoint := cfg.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+
+	creds := credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey.Value, "")
+	if cfg.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		})
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  creds,
+		Secure: u.Scheme == "https",
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client for %s: %w", cfg.Endpoint, err)
+	}
+
+	exists, err := client.BucketExists(context.Background(), cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access bucket %s: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", cfg.Bucket)
+	}
+	return &s3Destination{name: name, client: client, cfg: cfg, verify: verify}, nil
+}
+
+// key returns the object key of rel.
+func (d *s3Destination) key(rel string) string {
+	return path.Join(d.cfg.Prefix, rel)
+}
+
+// Name implements Destination.
+func (d *s3Destination) Name() string { return d.name }
+
+// Put implements Destination. Objects only become visible once the upload has
+// completed; large files are sent as multipart uploads. With verify the object
+// is read back afterwards and deleted again if its SHA-256 does not match.
+func (d *s3Destination) Put(rel string, r io.Reader, size int64) error {
+	partSize := d.cfg.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+	hash := sha256.New()
+	info, err := d.client.PutObject(context.Background(), d.cfg.Bucket, d.key(rel), io.TeeReader(r, hash), size, minio.PutObjectOptions{
+		StorageClass: d.cfg.StorageClass,
+		PartSize:     uint64(partSize) << 20,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to bucket %s: %w", rel, d.cfg.Bucket, err)
+	}
+	if err := d.verifyUpload(rel, info.Size, size, hash.Sum(nil)); err != nil {
+		d.Delete(rel)
+		return fmt.Errorf("verification of %s in bucket %s failed: %w", rel, d.cfg.Bucket, err)
+	}
+	return nil
+}
+
+// verifyUpload checks that an uploaded object has the expected size and, if
+// verify is set, reads it back to compare its SHA-256 with sum.
+func (d *s3Destination) verifyUpload(rel string, uploaded, size int64, sum []byte) error {
+	if uploaded != size {
+		return fmt.Errorf("uploaded %d bytes, expected %d", uploaded, size)
+	}
+	if !d.verify {
+		return nil
+	}
+	obj, err := d.client.GetObject(context.Background(), d.cfg.Bucket, d.key(rel), minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	return compareSHA256(obj, sum)
+}
+
+// List implements Destination.
+func (d *s3Destination) List(rel string) ([]RemoteFile, error) {
+	prefix := d.key(rel)
+	if prefix == "." || prefix == "" {
+		prefix = ""
+	} else {
+		prefix += "/"
+	}
+
+	var files []RemoteFile
+	for obj := range d.client.ListObjects(context.Background(), d.cfg.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list %s in bucket %s: %w", rel, d.cfg.Bucket, obj.Err)
+		}
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if strings.HasSuffix(name, "/") {
+			files = append(files, RemoteFile{Name: strings.TrimSuffix(name, "/"), IsDir: true})
+			continue
+		}
+		files = append(files, RemoteFile{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return files, nil
+}
+
+// Stat implements Destination.
+func (d *s3Destination) Stat(rel string) (RemoteFile, error) {
+	info, err := d.client.StatObject(context.Background(), d.cfg.Bucket, d.key(rel), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return RemoteFile{}, &os.PathError{Op: "stat", Path: rel, Err: os.ErrNotExist}
+		}
+		return RemoteFile{}, fmt.Errorf("failed to stat %s in bucket %s: %w", rel, d.cfg.Bucket, err)
+	}
+	return RemoteFile{Name: path.Base(rel), Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// Delete implements Destination.
+func (d *s3Destination) Delete(rel string) error {
+	return d.client.RemoveObject(context.Background(), d.cfg.Bucket, d.key(rel), minio.RemoveObjectOptions{})
+}
+
+// Move implements Destination. S3 cannot rename objects, so the object is
+// copied on the server and the original deleted. Objects over 5 GiB, the
+// limit of a single copy, are copied in parts.
+func (d *s3Destination) Move(from, to string) error {
+	if _, err := d.Stat(to); err == nil {
+		return fmt.Errorf("failed to move %s to %s in bucket %s: target exists", from, to, d.cfg.Bucket)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	src, err := d.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	dst := minio.CopyDestOptions{Bucket: d.cfg.Bucket, Object: d.key(to)}
+	srcOpts := minio.CopySrcOptions{Bucket: d.cfg.Bucket, Object: d.key(from)}
+	if src.Size > 5<<30 {
+		_, err = d.client.ComposeObject(context.Background(), dst, srcOpts)
+	} else {
+		_, err = d.client.CopyObject(context.Background(), dst, srcOpts)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s in bucket %s: %w", from, to, d.cfg.Bucket, err)
+	}
+	return d.Delete(from)
+}
+
+// Get implements Destination.
+func (d *s3Destination) Get(rel string) (io.ReadCloser, error) {
+	// GetObject is lazy, so a missing object is detected up front
+	if _, err := d.Stat(rel); err != nil {
+		return nil, err
+	}
+	obj, err := d.client.GetObject(context.Background(), d.cfg.Bucket, d.key(rel), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from bucket %s: %w", rel, d.cfg.Bucket, err)
+	}
+	return obj, nil
+}
+
+// Close implements Destination.
+func (d *s3Destination) Close() error { return nil }
@@ -0,0 +1,119 @@
+// Package backup
+package backup
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"backup-tool/config"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// newTestS3Destination starts an in-process S3 server with an empty bucket
+// and returns a destination storing below prefix in it.
+func newTestS3Destination(t *testing.T, prefix string) *s3Destination {
+	t.Helper()
+	backend := s3mem.New()
+	if err := backend.CreateBucket("backups"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+	t.Cleanup(server.Close)
+
+	dest, err := openS3Destination("s3", config.S3Destination{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		Bucket:    "backups",
+		Prefix:    prefix,
+		AccessKey: "test",
+		SecretKey: config.Secret{Value: "test-secret"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+func TestS3Destination(t *testing.T) {
+	dest := newTestS3Destination(t, "web01")
+	content := "archive content"
+	put := func(rel string) {
+		t.Helper()
+		if err := dest.Put(rel, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put %s: %v", rel, err)
+		}
+	}
+	put("dirs/www/dir_20260101_000000.tar.gz")
+	put("dirs/www/.index/dir_20260101_000000.tar.gz.json")
+
+	files, err := dest.List("dirs/www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("List returned %+v, want an archive and the .index directory", files)
+	}
+	for _, f := range files {
+		switch {
+		case f.Name == ".index" && f.IsDir:
+		case f.Name == "dir_20260101_000000.tar.gz" && !f.IsDir && f.Size == int64(len(content)):
+		default:
+			t.Errorf("unexpected entry %+v", f)
+		}
+	}
+	if files, err := dest.List("dirs/missing"); err != nil || len(files) != 0 {
+		t.Errorf("List of a missing directory = %+v, %v; want no entries", files, err)
+	}
+
+	if info, err := dest.Stat("dirs/www/dir_20260101_000000.tar.gz"); err != nil || info.Size != int64(len(content)) {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+	if _, err := dest.Stat("dirs/www/missing.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing object: %v, want a not-exist error", err)
+	}
+
+	if err := dest.Move("dirs/www/dir_20260101_000000.tar.gz", "dirs/var_www/dir_20260101_000000.tar.gz"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := dest.Stat("dirs/www/dir_20260101_000000.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("source still exists after Move: %v", err)
+	}
+	r, err := dest.Get("dirs/var_www/dir_20260101_000000.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != content {
+		t.Errorf("Get after Move = %q, %v; want %q", data, err, content)
+	}
+
+	put("dirs/www/dir_20260102_000000.tar.gz")
+	if err := dest.Move("dirs/www/dir_20260102_000000.tar.gz", "dirs/var_www/dir_20260101_000000.tar.gz"); err == nil {
+		t.Error("Move onto an existing object succeeded")
+	}
+
+	if err := dest.Delete("dirs/var_www/dir_20260101_000000.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := dest.List("dirs/var_www"); err != nil || len(files) != 0 {
+		t.Errorf("List after Delete = %+v, %v; want no entries", files, err)
+	}
+	if _, err := dest.Get("dirs/var_www/dir_20260101_000000.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("Get of a deleted object: %v, want a not-exist error", err)
+	}
+}
+
+func TestS3DestinationPutShortRead(t *testing.T) {
+	dest := newTestS3Destination(t, "")
+	if err := dest.Put("files/a/file.tar.gz", strings.NewReader("short"), 10); err == nil {
+		t.Fatal("Put with fewer bytes than announced succeeded")
+	}
+	if _, err := dest.Stat("files/a/file.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("incomplete object is visible: %v", err)
+	}
+}
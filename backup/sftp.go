@@ -0,0 +1,329 @@
+// Package backup
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"backup-tool/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpDestination stores backups in a directory on an SSH host.
+type sftpDestination struct {
+	name   string
+	conn   *ssh.Client
+	client *sftp.Client
+	root   string // remote directory the backup tree is stored under
+	verify bool   // read uploads back and compare their SHA-256 before renaming
+}
+
+// openSFTPDestination connects to the host described by cfg. The host key must
+// be listed in the known_hosts file.
+func openSFTPDestination(name string, cfg config.SFTPDestination, verify bool) (*sftpDestination, error) {
+	sshCfg, err := sshClientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+	conn, err := ssh.Dial("tcp", addr, sshCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SFTP host %s: %w", addr, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", addr, err)
+	}
+
+	root := cfg.Path
+	if root == "" {
+		root = "."
+	}
+	return &sftpDestination{name: name, conn: conn, client: client, root: root, verify: verify}, nil
+}
+
+// sshClientConfig builds the SSH authentication and host key settings of cfg.
+func sshClientConfig(cfg config.SFTPDestination) (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if cfg.KeyFile != "" {
+		key, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key %s: %w", cfg.KeyFile, err)
+		}
+		var signer ssh.Signer
+		if cfg.KeyPassphrase.Value != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.KeyPassphrase.Value))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key %s: %w", cfg.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password.Value != "" {
+		auth = append(auth, ssh.Password(cfg.Password.Value))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no SSH key file or password configured for %s", cfg.Host)
+	}
+
+	knownHostsPath := cfg.KnownHosts
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate known_hosts: %w", err)
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts from %s: %w", knownHostsPath, err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// path returns the remote path of rel.
+func (d *sftpDestination) path(rel string) string {
+	return path.Join(d.root, rel)
+}
+
+// Name implements Destination.
+func (d *sftpDestination) Name() string { return d.name }
+
+// resumesUploads implements resumingDestination.
+func (d *sftpDestination) resumesUploads() {}
+
+// Put implements Destination. The data is written to a temporary .partial name
+// and renamed once it is complete and checked (size, and SHA-256 if verify is
+// set). If a .partial file from an interrupted upload exists and r is an
+// io.Seeker, the upload continues where it stopped.
+func (d *sftpDestination) Put(rel string, r io.Reader, size int64) error {
+	fullPath := d.path(rel)
+	if err := d.client.MkdirAll(path.Dir(fullPath)); err != nil {
+		return fmt.Errorf("failed to create directory %s on SFTP: %w", path.Dir(fullPath), err)
+	}
+
+	tmpPath := partialName(fullPath)
+	hash := sha256.New()
+	offset, err := d.resumeOffset(tmpPath, r, size, hash)
+	if err != nil {
+		return fmt.Errorf("failed to resume upload of %s: %w", rel, err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+		fmt.Printf("↩️ Resuming upload of %s on %s at %d of %d bytes\n", rel, d.name, offset, size)
+	}
+	dstFile, err := d.client.OpenFile(tmpPath, flags)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s on SFTP: %w", tmpPath, err)
+	}
+	if offset > 0 {
+		if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
+			dstFile.Close()
+			return fmt.Errorf("failed to resume upload of %s: %w", rel, err)
+		}
+	}
+
+	// The .partial file is kept on errors so the next run can resume it
+	written, err := io.Copy(dstFile, io.TeeReader(r, hash))
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && offset+written != size {
+		err = fmt.Errorf("read %d bytes, expected %d", offset+written, size)
+	}
+	if err != nil {
+		return fmt.Errorf("error copying %s to SFTP: %w", rel, err)
+	}
+
+	if err := d.verifyUpload(tmpPath, size, hash.Sum(nil)); err != nil {
+		d.client.Remove(tmpPath)
+		return fmt.Errorf("verification of %s on SFTP failed: %w", rel, err)
+	}
+
+	if _, ok := d.client.HasExtension("posix-rename@openssh.com"); ok {
+		err = d.client.PosixRename(tmpPath, fullPath)
+	} else {
+		// Plain SFTP rename does not replace an existing file
+		if _, statErr := d.client.Stat(fullPath); statErr == nil {
+			if err := d.client.Remove(fullPath); err != nil {
+				d.client.Remove(tmpPath)
+				return fmt.Errorf("failed to replace %s on SFTP: %w", rel, err)
+			}
+		}
+		err = d.client.Rename(tmpPath, fullPath)
+	}
+	if err != nil {
+		d.client.Remove(tmpPath)
+		return fmt.Errorf("failed to rename %s to %s on SFTP: %w", tmpPath, fullPath, err)
+	}
+	return nil
+}
+
+// resumeOffset returns how many bytes of an interrupted upload can be kept.
+// The data before that offset is read from r into h, leaving r positioned
+// at the offset. Uploads are restarted if r cannot seek, the .partial file
+// is not shorter than the source or its content differs from the start of
+// the source (it may be left by an upload of different content, such as a
+// sealed manifest of an earlier run).
+func (d *sftpDestination) resumeOffset(tmpPath string, r io.Reader, size int64, h hash.Hash) (int64, error) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return 0, nil
+	}
+	info, err := d.client.Stat(tmpPath)
+	if err != nil || info.Size() == 0 || info.Size() >= size {
+		return 0, nil
+	}
+
+	offset := info.Size()
+	remoteSum, err := d.prefixSHA256(tmpPath, offset)
+	if err != nil {
+		return 0, nil
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	sourceHash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(h, sourceHash), r, offset); err != nil {
+		return 0, err
+	}
+	if bytes.Equal(sourceHash.Sum(nil), remoteSum) {
+		return offset, nil
+	}
+
+	fmt.Printf("ℹ️ Restarting upload to %s on %s: its content differs from the source\n", tmpPath, d.name)
+	h.Reset()
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// prefixSHA256 returns the SHA-256 of the first n bytes of a remote file.
+func (d *sftpDestination) prefixSHA256(remotePath string, n int64) ([]byte, error) {
+	f, err := d.client.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, n); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyUpload checks that an uploaded file has the expected size and, if
+// verify is set, reads it back to compare its SHA-256 with sum.
+func (d *sftpDestination) verifyUpload(remotePath string, size int64, sum []byte) error {
+	info, err := d.client.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("size is %d bytes, expected %d", info.Size(), size)
+	}
+	if !d.verify {
+		return nil
+	}
+
+	f, err := d.client.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return compareSHA256(f, sum)
+}
+
+// List implements Destination.
+func (d *sftpDestination) List(rel string) ([]RemoteFile, error) {
+	infos, err := d.client.ReadDir(d.path(rel))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s on SFTP: %w", rel, err)
+	}
+	files := make([]RemoteFile, 0, len(infos))
+	for _, fi := range infos {
+		files = append(files, remoteFileFromInfo(fi))
+	}
+	return files, nil
+}
+
+// Stat implements Destination.
+func (d *sftpDestination) Stat(rel string) (RemoteFile, error) {
+	fi, err := d.client.Stat(d.path(rel))
+	if errors.Is(err, os.ErrNotExist) {
+		return RemoteFile{}, &os.PathError{Op: "stat", Path: rel, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("failed to stat %s on SFTP: %w", rel, err)
+	}
+	return remoteFileFromInfo(fi), nil
+}
+
+// Delete implements Destination.
+func (d *sftpDestination) Delete(rel string) error {
+	return d.client.Remove(d.path(rel))
+}
+
+// Move implements Destination.
+func (d *sftpDestination) Move(from, to string) error {
+	fullPath := d.path(to)
+	// OpenSSH refuses to rename onto an existing file, but not every server does
+	if _, err := d.client.Stat(fullPath); err == nil {
+		return fmt.Errorf("failed to move %s to %s on SFTP: target exists", from, to)
+	}
+	if err := d.client.MkdirAll(path.Dir(fullPath)); err != nil {
+		return fmt.Errorf("failed to create directory %s on SFTP: %w", path.Dir(fullPath), err)
+	}
+	if err := d.client.Rename(d.path(from), fullPath); err != nil {
+		return fmt.Errorf("failed to move %s to %s on SFTP: %w", from, to, err)
+	}
+	return nil
+}
+
+// Get implements Destination.
+func (d *sftpDestination) Get(rel string) (io.ReadCloser, error) {
+	f, err := d.client.Open(d.path(rel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s on SFTP: %w", rel, err)
+	}
+	return f, nil
+}
+
+// Close implements Destination.
+func (d *sftpDestination) Close() error {
+	d.client.Close()
+	return d.conn.Close()
+}
@@ -0,0 +1,285 @@
+// Package backup
+package backup
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backup-tool/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an in-process SSH server with an SFTP subsystem serving
+// a temporary directory.
+type testSFTPServer struct {
+	addr    *net.TCPAddr
+	hostKey ssh.PublicKey
+	dir     string
+}
+
+// newTestSSHKey returns a new ed25519 signer.
+func newTestSSHKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startTestSFTPServer accepts the user "backup" with the password "secret".
+func startTestSFTPServer(t *testing.T) *testSFTPServer {
+	t.Helper()
+	hostKey := newTestSSHKey(t)
+	serverCfg := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	serverCfg.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testSFTPServer{addr: listener.Addr().(*net.TCPAddr), hostKey: hostKey.PublicKey(), dir: t.TempDir()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, serverCfg)
+		}
+	}()
+	return server
+}
+
+// serve handles one SSH connection.
+func (s *testSFTPServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.dir))
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+			}
+		}()
+	}
+}
+
+// config returns destination settings for the server, trusting hostKey.
+func (s *testSFTPServer) config(t *testing.T, hostKey ssh.PublicKey) config.SFTPDestination {
+	t.Helper()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr.String())}, hostKey)
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config.SFTPDestination{
+		Host:       "127.0.0.1",
+		Port:       s.addr.Port,
+		User:       "backup",
+		Password:   config.Secret{Value: "secret"},
+		KnownHosts: knownHosts,
+		Path:       "backups",
+	}
+}
+
+// openTestSFTPDestination connects to a new test server.
+func openTestSFTPDestination(t *testing.T, verify bool) (*sftpDestination, *testSFTPServer) {
+	t.Helper()
+	server := startTestSFTPServer(t)
+	dest, err := openSFTPDestination("sftp", server.config(t, server.hostKey), verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dest.Close() })
+	return dest, server
+}
+
+func TestSFTPDestinationRejectsUnknownHostKey(t *testing.T) {
+	server := startTestSFTPServer(t)
+	other := newTestSSHKey(t).PublicKey()
+	dest, err := openSFTPDestination("sftp", server.config(t, other), false)
+	if err == nil {
+		dest.Close()
+		t.Fatal("connected to a host whose key is not in known_hosts")
+	}
+	if !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSFTPDestination(t *testing.T) {
+	dest, server := openTestSFTPDestination(t, true)
+	content := "archive content"
+	if err := dest.Put("dirs/www/dir_20260101_000000.tar.gz", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	files, err := dest.List("dirs/www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "dir_20260101_000000.tar.gz" || files[0].Size != int64(len(content)) {
+		t.Fatalf("List = %+v, want only the uploaded archive", files)
+	}
+	if files, err := dest.List("dirs/missing"); err != nil || len(files) != 0 {
+		t.Errorf("List of a missing directory = %+v, %v; want no entries", files, err)
+	}
+
+	if err := dest.Move("dirs/www/dir_20260101_000000.tar.gz", "dirs/var_www/dir_20260101_000000.tar.gz"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := dest.Stat("dirs/www/dir_20260101_000000.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("source still exists after Move: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(server.dir, "backups/dirs/var_www/dir_20260101_000000.tar.gz"))
+	if err != nil || string(data) != content {
+		t.Errorf("moved file = %q, %v; want %q", data, err, content)
+	}
+
+	if err := dest.Put("dirs/www/dir_20260102_000000.tar.gz", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Move("dirs/www/dir_20260102_000000.tar.gz", "dirs/var_www/dir_20260101_000000.tar.gz"); err == nil {
+		t.Error("Move onto an existing file succeeded")
+	}
+
+	if err := dest.Delete("dirs/var_www/dir_20260101_000000.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dest.Stat("dirs/var_www/dir_20260101_000000.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("file still exists after Delete: %v", err)
+	}
+}
+
+// writeTestPartial leaves data as the .partial file of rel on the server.
+func writeTestPartial(t *testing.T, server *testSFTPServer, rel, data string) string {
+	t.Helper()
+	partial := filepath.Join(server.dir, "backups", filepath.FromSlash(partialName(rel)))
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return partial
+}
+
+func TestSFTPDestinationResumeOffset(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	tests := []struct {
+		name    string
+		partial string
+		want    int64
+	}{
+		{"matching prefix", content[:4000], 4000},
+		{"differing prefix", strings.Repeat("x", 4000), 0},
+		{"as long as the source", content, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, server := openTestSFTPDestination(t, false)
+			rel := "dirs/www/dir_20260101_000000.tar.gz"
+			writeTestPartial(t, server, rel, tt.partial)
+
+			r := strings.NewReader(content)
+			h := sha256.New()
+			offset, err := dest.resumeOffset(dest.path(partialName(rel)), r, int64(len(content)), h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != tt.want {
+				t.Fatalf("offset = %d, want %d", offset, tt.want)
+			}
+			// The source is positioned at the offset, with the data before it hashed
+			if pos := int64(len(content)) - int64(r.Len()); pos != offset {
+				t.Errorf("source is at %d, want %d", pos, offset)
+			}
+			if want := sha256.Sum256([]byte(content[:offset])); !bytes.Equal(h.Sum(nil), want[:]) {
+				t.Error("hash does not cover the data before the offset")
+			}
+		})
+	}
+}
+
+func TestSFTPDestinationRestartsDifferingUpload(t *testing.T) {
+	// Without verify, a stale .partial of other content must not end up in
+	// the uploaded file
+	dest, server := openTestSFTPDestination(t, false)
+	content := strings.Repeat("0123456789", 1000)
+	rel := "dirs/www/dir_20260101_000000.tar.gz"
+	partial := writeTestPartial(t, server, rel, strings.Repeat("x", 4000))
+
+	if err := dest.Put(rel, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(server.dir, "backups", filepath.FromSlash(rel)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("uploaded file does not match the source (%d bytes)", len(data))
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf(".partial file left after the upload: %v", err)
+	}
+}
+
+func TestSFTPDestinationResumesUpload(t *testing.T) {
+	dest, server := openTestSFTPDestination(t, true)
+	content := strings.Repeat("0123456789", 1000)
+	rel := "dirs/www/dir_20260101_000000.tar.gz"
+	writeTestPartial(t, server, rel, content[:4000])
+
+	if err := dest.Put(rel, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(server.dir, "backups", filepath.FromSlash(rel)))
+	if err != nil || string(data) != content {
+		t.Errorf("resumed upload = %d bytes, %v; want the source", len(data), err)
+	}
+}
@@ -1,136 +1,210 @@
 package backup
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"net"
-	"strings"
-	"time"
+	"os"
+	"path"
 
 	"backup-tool/config"
-	"backup-tool/utils"
 	"github.com/hirochachacha/go-smb2"
 )
 
-type SMBItem struct {
-	Prefix   string
-	Lifetime int
-}
-
-// CleanupSMB removes old backups on SMB share according to specified lifetime.
-func CleanupSMB(upload config.Upload, items []SMBItem) error {
-	if !upload.Active {
-		return nil
-	}
-
-	conn, err := net.Dial("tcp", upload.SMBHost+":445")
+// connectSMB dials the SMB host, authenticates and mounts the configured share.
+// The returned function unmounts the share and closes the connection.
+func connectSMB(cfg config.SMBDestination) (*smb2.Share, func(), error) {
+	conn, err := net.Dial("tcp", cfg.Host+":445")
 	if err != nil {
-		return fmt.Errorf("failed to connect to SMB: %w", err)
+		return nil, nil, fmt.Errorf("failed to connect to SMB: %w", err)
 	}
-	defer conn.Close()
 
 	d := &smb2.Dialer{
 		Initiator: &smb2.NTLMInitiator{
-			User:     upload.SMBUser,
-			Password: upload.SMBPassword,
-			Domain:   upload.Domain,
+			User:     cfg.User,
+			Password: cfg.Password.Value,
+			Domain:   cfg.Domain,
 		},
 	}
 
 	s, err := d.Dial(conn)
 	if err != nil {
-		return fmt.Errorf("SMB authentication error: %w", err)
+		conn.Close()
+		return nil, nil, fmt.Errorf("SMB authentication error: %w", err)
 	}
-	defer s.Logoff()
 
-	fs, err := s.Mount(upload.SMBShare)
+	fs, err := s.Mount(cfg.Share)
 	if err != nil {
-		return fmt.Errorf("failed to mount share: %w", err)
-	}
-	defer fs.Umount()
-
-	now := time.Now()
-	cutoffTime := now.AddDate(0, 0, -1) // Default if lifetime is not specified
-
-	for _, item := range items {
-		var smbDir string
-		var prefix string
-
-		// Determine SMB path and file prefix
-		switch {
-		case strings.HasPrefix(item.Prefix, "db_"):
-			dbName := strings.TrimPrefix(item.Prefix, "db_")
-			smbDir = fmt.Sprintf("databases/%s", dbName)
-			prefix = "db_"
-		case strings.HasPrefix(item.Prefix, "dir_"):
-			dirName := strings.TrimPrefix(item.Prefix, "dir_")
-			smbDir = fmt.Sprintf("dirs/%s", dirName)
-			prefix = "dir_"
-		case strings.HasPrefix(item.Prefix, "file_"):
-			fileName := strings.TrimPrefix(item.Prefix, "file_")
-			smbDir = fmt.Sprintf("files/%s", fileName)
-			prefix = "file_"
-		case strings.HasPrefix(item.Prefix, "log_"):
-			logName := strings.TrimPrefix(item.Prefix, "log_")
-			smbDir = fmt.Sprintf("logs/%s", logName)
-			prefix = "log_"
-		default:
-			fmt.Printf("⚠️ Unknown prefix for cleanup: %s\n", item.Prefix)
-			continue
-		}
+		s.Logoff()
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to mount share %s: %w", cfg.Share, err)
+	}
 
-		// Calculate cutoff time for this item
-		if item.Lifetime > 0 {
-			cutoffTime = now.AddDate(0, 0, -item.Lifetime)
-		}
+	return fs, func() {
+		fs.Umount()
+		s.Logoff()
+		conn.Close()
+	}, nil
+}
+
+// smbDestination stores backups on an SMB share.
+type smbDestination struct {
+	name    string
+	fs      *smb2.Share
+	closeFn func()
+	verify  bool // read uploads back and compare their SHA-256 before renaming
+}
+
+// openSMBDestination connects to the share described by cfg.
+func openSMBDestination(name string, cfg config.SMBDestination, verify bool) (*smbDestination, error) {
+	fs, closeFn, err := connectSMB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &smbDestination{name: name, fs: fs, closeFn: closeFn, verify: verify}, nil
+}
 
-		// Read subdirectory contents on SMB
-		fileInfos, err := fs.ReadDir(smbDir)
-		if err != nil {
-			// Directory may not exist - this is normal, skip
-			fmt.Printf("ℹ️ Directory %s not found on SMB (backups may not exist yet)\n", smbDir)
-			continue
+// Name implements Destination.
+func (d *smbDestination) Name() string { return d.name }
+
+// Put implements Destination. The data is written to a temporary .partial name,
+// synced, closed and checked (size, and SHA-256 if verify is set) before it is
+// renamed to its final name, so an interrupted upload never leaves a truncated
+// file under the final name.
+func (d *smbDestination) Put(rel string, r io.Reader, size int64) error {
+	if dir := path.Dir(rel); dir != "." {
+		if err := d.fs.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s on SMB: %w", dir, err)
 		}
+	}
 
-		deletedCount := 0
-		for _, fi := range fileInfos {
-			name := fi.Name()
-			if fi.IsDir() {
-				continue
-			}
-
-			// Check that file matches backup format
-			if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".tar.gz") {
-				continue
-			}
-
-			// Try to extract time from filename
-			backupTime, ok := utils.GetBackupTimeFromName(name)
-			if !ok {
-				// If we can't extract time from name, we could use file modification time
-				// But for that we need to get full path and check via Stat
-				// For simplicity, skip such files or use a more conservative approach
-				fmt.Printf("⚠️ Failed to determine backup time from filename: %s (skipping)\n", name)
-				continue
-			}
-
-			// Check if file should be deleted
-			if backupTime.Before(cutoffTime) {
-				// Use correct path formation for SMB (always /)
-				fullPath := strings.TrimSuffix(smbDir, "/") + "/" + name
-				if err := fs.Remove(fullPath); err != nil {
-					fmt.Printf("⚠️ Failed to delete %s on SMB: %v\n", fullPath, err)
-				} else {
-					fmt.Printf("🗑️ Deleted old backup on SMB: %s (age: %d days)\n",
-						fullPath, int(now.Sub(backupTime).Hours()/24))
-					deletedCount++
-				}
-			}
+	tmpPath := partialName(rel)
+	dstFile, err := d.fs.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s on SMB: %w", tmpPath, err)
+	}
+
+	// Upload using streaming for large files
+	hash := sha256.New()
+	written, err := io.Copy(dstFile, io.TeeReader(r, hash))
+	if err == nil {
+		err = dstFile.Sync()
+	}
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written != size {
+		err = fmt.Errorf("read %d bytes, expected %d", written, size)
+	}
+	if err != nil {
+		d.fs.Remove(tmpPath)
+		return fmt.Errorf("error copying %s to SMB: %w", rel, err)
+	}
+
+	if err := d.verifyUpload(tmpPath, written, hash.Sum(nil)); err != nil {
+		d.fs.Remove(tmpPath)
+		return fmt.Errorf("verification of %s on SMB failed: %w", rel, err)
+	}
+
+	// Rename does not replace an existing file, so an outdated copy is removed first
+	if _, err := d.fs.Stat(rel); err == nil {
+		if err := d.fs.Remove(rel); err != nil {
+			d.fs.Remove(tmpPath)
+			return fmt.Errorf("failed to replace %s on SMB: %w", rel, err)
 		}
+	}
+	if err := d.fs.Rename(tmpPath, rel); err != nil {
+		d.fs.Remove(tmpPath)
+		return fmt.Errorf("failed to rename %s to %s on SMB: %w", tmpPath, rel, err)
+	}
+	return nil
+}
 
-		if deletedCount > 0 {
-			fmt.Printf("✅ Cleaned up %d old backups in %s\n", deletedCount, smbDir)
+// verifyUpload checks that an uploaded file has the expected size and, if
+// verify is set, reads it back to compare its SHA-256 with sum.
+func (d *smbDestination) verifyUpload(smbPath string, size int64, sum []byte) error {
+	info, err := d.fs.Stat(smbPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("size is %d bytes, expected %d", info.Size(), size)
+	}
+	if !d.verify {
+		return nil
+	}
+
+	f, err := d.fs.Open(smbPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return compareSHA256(f, sum)
+}
+
+// List implements Destination.
+func (d *smbDestination) List(rel string) ([]RemoteFile, error) {
+	if rel == "." {
+		rel = ""
+	}
+	infos, err := d.fs.ReadDir(rel)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s on SMB: %w", rel, err)
+	}
+	files := make([]RemoteFile, 0, len(infos))
+	for _, fi := range infos {
+		files = append(files, remoteFileFromInfo(fi))
+	}
+	return files, nil
+}
+
+// Stat implements Destination.
+func (d *smbDestination) Stat(rel string) (RemoteFile, error) {
+	fi, err := d.fs.Stat(rel)
+	if err != nil {
+		return RemoteFile{}, err
+	}
+	return remoteFileFromInfo(fi), nil
+}
+
+// Delete implements Destination.
+func (d *smbDestination) Delete(rel string) error {
+	return d.fs.Remove(rel)
+}
+
+// Move implements Destination.
+func (d *smbDestination) Move(from, to string) error {
+	if dir := path.Dir(to); dir != "." {
+		if err := d.fs.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s on SMB: %w", dir, err)
 		}
 	}
+	if err := d.fs.Rename(from, to); err != nil {
+		return fmt.Errorf("failed to move %s to %s on SMB: %w", from, to, err)
+	}
+	return nil
+}
 
+// Get implements Destination.
+func (d *smbDestination) Get(rel string) (io.ReadCloser, error) {
+	f, err := d.fs.Open(rel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s on SMB: %w", rel, err)
+	}
+	return f, nil
+}
+
+// Close implements Destination.
+func (d *smbDestination) Close() error {
+	d.closeFn()
 	return nil
 }
+
+// remoteFileFromInfo converts an os.FileInfo into a RemoteFile.
+func remoteFileFromInfo(fi os.FileInfo) RemoteFile {
+	return RemoteFile{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()}
+}
@@ -0,0 +1,86 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+)
+
+// ItemResult describes the outcome of backing up a single item.
+type ItemResult struct {
+	Kind     string // dir, file, log or db
+	Source   string // path or database name
+	Archive  string // archive written, empty if none
+	Err      error  // set if the backup failed
+	Skipped  bool   // source did not exist
+	Planned  bool   // dry run: Archive would be written
+	Excluded int    // entries left out by exclude/include patterns
+	Patterns string // exclude/include patterns in effect
+}
+
+// Summary collects the results of a run so they can be reported at the end.
+// A nil *Summary is valid and records nothing.
+type Summary struct {
+	Items   []ItemResult
+	Uploads []UploadStats // one per destination uploaded to
+}
+
+// add records the result of one item.
+func (s *Summary) add(r ItemResult) {
+	if s == nil {
+		return
+	}
+	s.Items = append(s.Items, r)
+}
+
+// addUpload records the statistics of an upload.
+func (s *Summary) addUpload(stats UploadStats) {
+	if s == nil {
+		return
+	}
+	s.Uploads = append(s.Uploads, stats)
+}
+
+// failed reports whether the backup of the item with the given kind and
+// source failed in this run.
+func (s *Summary) failed(kind, source string) bool {
+	if s == nil {
+		return false
+	}
+	for _, r := range s.Items {
+		if r.Kind == kind && r.Source == source && r.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the run summary to stdout.
+func (s *Summary) Print() {
+	if s == nil || (len(s.Items) == 0 && len(s.Uploads) == 0) {
+		return
+	}
+
+	fmt.Println("📋 Run summary:")
+	for _, r := range s.Items {
+		switch {
+		case r.Err != nil:
+			fmt.Printf("   ❌ %s %s: %v\n", r.Kind, r.Source, r.Err)
+		case r.Planned:
+			fmt.Printf("   🔍 %s %s → %s (dry run)\n", r.Kind, r.Source, r.Archive)
+		case r.Skipped:
+			fmt.Printf("   ⏭️ %s %s: source does not exist\n", r.Kind, r.Source)
+		default:
+			fmt.Printf("   ✅ %s %s → %s\n", r.Kind, r.Source, r.Archive)
+		}
+		if r.Patterns != "" {
+			fmt.Printf("      %d entries skipped (%s)\n", r.Excluded, r.Patterns)
+		}
+	}
+	for _, u := range s.Uploads {
+		if u.DryRun {
+			fmt.Printf("   🔍 %s: %d files would be uploaded (%d bytes), %d already present\n", u.Destination, u.Uploaded, u.Bytes, u.Skipped)
+			continue
+		}
+		fmt.Printf("   📤 %s: %d files uploaded (%d bytes), %d already present\n", u.Destination, u.Uploaded, u.Bytes, u.Skipped)
+	}
+}
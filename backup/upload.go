@@ -2,125 +2,293 @@
 package backup
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
-	"syscall"
 
 	"backup-tool/config"
-	"github.com/hirochachacha/go-smb2"
 )
 
-// UploadToSMB recursively uploads contents of localPath to SMB share,
-// preserving directory structure.
-func UploadToSMB(localPath string, upload config.Upload) error {
-	if !upload.Active {
-		return nil
-	}
+const (
+	// checksumSuffix is appended to the name of a file to form its checksum sidecar.
+	checksumSuffix = ".sha256"
+	// partialSuffix marks files that are still being uploaded.
+	partialSuffix = ".partial"
+)
+
+// UploadStats counts what an upload run transferred.
+type UploadStats struct {
+	Destination string
+	Uploaded    int
+	Skipped     int   // already present remotely with the same size (and checksum)
+	Bytes       int64 // bytes transferred
+	DryRun      bool  // nothing was transferred, the counts are what would be
+}
 
+// UploadToDestination recursively uploads contents of localPath to a destination,
+// preserving directory structure. Files that already exist there with the same
+// size (and, if cfg.Checksum is set, the same SHA-256) are skipped, and .partial
+// files left by interrupted uploads are removed (or resumed by destinations
+// that support it). Metadata is reduced or sealed with enc, see uploadContent.
+// With dryRun the files that would be uploaded are only listed.
+func UploadToDestination(localPath string, cfg config.Destination, enc *config.Encryption, dryRun bool, summary *Summary) error {
 	// Normalize local path for correct comparison
 	localPath, err := filepath.Abs(localPath)
 	if err != nil {
 		return fmt.Errorf("failed to get absolute path: %w", err)
 	}
 	localPath = filepath.Clean(localPath)
+	if _, err := os.Stat(localPath); os.IsNotExist(err) && dryRun {
+		fmt.Printf("🔍 Nothing to upload to %s yet: %s does not exist\n", cfg.Name, localPath)
+		return nil
+	}
 
-	conn, err := net.Dial("tcp", upload.SMBHost+":445")
+	dest, err := OpenDestination(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to connect to SMB: %w", err)
+		return err
 	}
-	defer conn.Close()
+	defer dest.Close()
 
-	d := &smb2.Dialer{
-		Initiator: &smb2.NTLMInitiator{
-			User:     upload.SMBUser,
-			Password: upload.SMBPassword,
-			Domain:   upload.Domain,
-		},
-	}
+	return uploadTree(localPath, dest, enc, cfg.Checksum, dryRun, summary)
+}
 
-	s, err := d.Dial(conn)
-	if err != nil {
-		return fmt.Errorf("SMB authentication error: %w", err)
-	}
-	defer s.Logoff()
+// uploadTree mirrors the files below localPath to dest.
+func uploadTree(localPath string, dest Destination, enc *config.Encryption, checksums, dryRun bool, summary *Summary) error {
+	fmt.Printf("📤 Starting upload to %s...\n", dest.Name())
 
-	fs, err := s.Mount(upload.SMBShare)
-	if err != nil {
-		return fmt.Errorf("failed to mount share %s: %w", upload.SMBShare, err)
-	}
-	defer fs.Umount()
+	stats := UploadStats{Destination: dest.Name(), DryRun: dryRun}
+	defer func() {
+		if dryRun {
+			fmt.Printf("🔍 Upload to %s would transfer %d files (%d bytes), %d skipped\n", dest.Name(), stats.Uploaded, stats.Bytes, stats.Skipped)
+		} else {
+			fmt.Printf("📤 Upload to %s finished: %d uploaded (%d bytes), %d skipped\n", dest.Name(), stats.Uploaded, stats.Bytes, stats.Skipped)
+		}
+		summary.addUpload(stats)
+	}()
 
-	fmt.Println("📤 Starting upload to SMB...")
+	// Leftover .partial files are resumed by Put on destinations that support
+	// it; those not picked up by this run are removed at the end
+	_, resumes := dest.(resumingDestination)
+	partials := make(map[string]bool)
+	defer func() {
+		for rel := range partials {
+			removeStalePartial(dest, rel, dryRun)
+		}
+	}()
 
-	// Recursively walk local directory
-	return filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+	// Remote directory listings, read once per directory
+	listings := make(map[string]map[string]RemoteFile)
+	listing := func(dir string) (map[string]RemoteFile, error) {
+		if files, ok := listings[dir]; ok {
+			return files, nil
+		}
+		entries, err := dest.List(dir)
 		if err != nil {
-			return fmt.Errorf("error walking %s: %w", path, err)
+			return nil, err
+		}
+		files := make(map[string]RemoteFile, len(entries))
+		for _, f := range entries {
+			if !f.IsDir && isPartialName(f.Name) {
+				if resumes {
+					partials[path.Join(dir, f.Name)] = true
+				} else {
+					removeStalePartial(dest, path.Join(dir, f.Name), dryRun)
+				}
+				continue
+			}
+			files[f.Name] = f
 		}
+		listings[dir] = files
+		return files, nil
+	}
 
-		// Relative path from localPath
-		relPath, err := filepath.Rel(localPath, path)
+	// Recursively walk local directory
+	return filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
-			return fmt.Errorf("failed to get relative path for %s: %w", path, err)
+			return fmt.Errorf("error walking %s: %w", filePath, err)
+		}
+		if info.IsDir() {
+			// Directories are created by the destination as files are stored
+			return nil
 		}
 
-		// Skip root directory (relPath will be ".")
-		if relPath == "." {
+		// Relative path from localPath, with / as separator
+		relPath, err := filepath.Rel(localPath, filePath)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for %s: %w", filePath, err)
+		}
+		rel := filepath.ToSlash(relPath)
+		// Files still being written are uploaded by the run that completes them
+		if rel == layoutMarker || isTempName(info.Name()) {
 			return nil
 		}
 
-		// Convert separators to /
-		smbPath := strings.ReplaceAll(relPath, string(filepath.Separator), "/")
+		remoteFiles, err := listing(path.Dir(rel))
+		if err != nil {
+			return err
+		}
 
-		if info.IsDir() {
-			// Create directory on SMB
-			if err := fs.Mkdir(smbPath, 0755); err != nil {
-				// Check if error is related to directory existence
-				if pathErr, ok := err.(*os.PathError); ok {
-					if pathErr.Err == syscall.EEXIST || pathErr.Err == syscall.EISDIR {
-						// Directory already exists - this is fine
-						return nil
-					}
-				}
-				// If error is not related to existence, check text (for cross-platform compatibility)
-				errStr := err.Error()
-				if !strings.Contains(errStr, "exists") &&
-					!strings.Contains(errStr, "EEXIST") &&
-					!strings.Contains(errStr, "file exists") {
-					return fmt.Errorf("failed to create directory %s on SMB: %w", smbPath, err)
-				}
-			} else {
-				fmt.Printf("📁 Created directory on SMB: %s\n", smbPath)
-			}
-		} else {
-			// Upload file using streaming for large files
-			srcFile, err := os.Open(path)
-			if err != nil {
-				return fmt.Errorf("failed to open file %s: %w", path, err)
-			}
-			defer srcFile.Close()
+		content, err := uploadContent(rel, filePath, enc)
+		if err != nil {
+			return err
+		}
+		size := info.Size()
+		if content != nil {
+			size = int64(len(content))
+		}
 
-			dstFile, err := fs.Create(smbPath)
-			if err != nil {
-				return fmt.Errorf("failed to create file %s on SMB: %w", smbPath, err)
+		var checksum string
+		if checksums {
+			if content != nil {
+				sum := sha256.Sum256(content)
+				checksum = hex.EncodeToString(sum[:])
+			} else if checksum, err = fileSHA256(filePath); err != nil {
+				return err
 			}
+		}
 
-			written, err := io.Copy(dstFile, srcFile)
-			if err != nil {
-				dstFile.Close()
-				return fmt.Errorf("error copying %s to SMB: %w", smbPath, err)
+		// Skip files that are already on the destination. Content derived
+		// from the local file is compared by size only, since sealed
+		// manifests differ in every run.
+		if remote, ok := remoteFiles[path.Base(rel)]; ok && !remote.IsDir && remote.Size == size {
+			if !checksums || content != nil || remoteChecksum(dest, rel) == checksum {
+				stats.Skipped++
+				return nil
 			}
+		}
 
-			if err := dstFile.Close(); err != nil {
-				return fmt.Errorf("error closing file %s on SMB: %w", smbPath, err)
+		delete(partials, partialName(rel))
+		if dryRun {
+			stats.Uploaded++
+			stats.Bytes += size
+			fmt.Printf("🔍 Would upload to %s: %s (%d bytes)\n", dest.Name(), rel, size)
+			return nil
+		}
+		if content != nil {
+			err = dest.Put(rel, bytes.NewReader(content), size)
+		} else {
+			srcFile, openErr := os.Open(filePath)
+			if openErr != nil {
+				return fmt.Errorf("failed to open file %s: %w", filePath, openErr)
 			}
+			err = dest.Put(rel, srcFile, size)
+			srcFile.Close()
+		}
+		if err != nil {
+			return err
+		}
 
-			fmt.Printf("✅ Uploaded: %s (%d bytes)\n", smbPath, written)
+		if checksums {
+			sidecar := fmt.Sprintf("%s  %s\n", checksum, path.Base(rel))
+			if err := dest.Put(rel+checksumSuffix, strings.NewReader(sidecar), int64(len(sidecar))); err != nil {
+				return fmt.Errorf("failed to write checksum of %s on %s: %w", rel, dest.Name(), err)
+			}
+		} else if _, ok := remoteFiles[path.Base(rel)+checksumSuffix]; ok {
+			// A sidecar left from a run with checksums enabled no longer matches
+			dest.Delete(rel + checksumSuffix)
 		}
+
+		stats.Uploaded++
+		stats.Bytes += size
+		fmt.Printf("✅ Uploaded to %s: %s (%d bytes)\n", dest.Name(), rel, size)
 		return nil
 	})
 }
+
+// uploadContent returns what is stored on destinations in place of the local
+// file rel, or nil if it is uploaded as is. Snapshot indexes are reduced to
+// the chain remote retention follows, since their file lists only serve the
+// next local run; with encryption, repository snapshot manifests are sealed.
+func uploadContent(rel, filePath string, enc *config.Encryption) ([]byte, error) {
+	isIndex := path.Base(path.Dir(rel)) == indexDirName && strings.HasSuffix(rel, ".json")
+	isSnapshot := strings.HasPrefix(rel, repositoryDirName+"/snapshots/") && strings.HasSuffix(rel, ".json")
+	if !isIndex && !(isSnapshot && enc != nil) {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+	if isSnapshot {
+		if data, err = sealSnapshot(data, enc); err != nil {
+			return nil, fmt.Errorf("failed to seal snapshot %s: %w", rel, err)
+		}
+		return data, nil
+	}
+
+	var idx snapshotIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("error parsing snapshot index %s: %w", filePath, err)
+	}
+	return json.Marshal(struct {
+		Archive string `json:"archive"`
+		archiveManifest
+	}{idx.Archive, idx.archiveManifest})
+}
+
+// removeStalePartial deletes a .partial file left by an interrupted upload.
+func removeStalePartial(dest Destination, rel string, dryRun bool) {
+	if dryRun {
+		fmt.Printf("🗑️ Would delete stale partial upload on %s: %s\n", dest.Name(), rel)
+		return
+	}
+	if err := dest.Delete(rel); err != nil {
+		fmt.Printf("⚠️ Failed to delete stale partial upload %s on %s: %v\n", rel, dest.Name(), err)
+	} else {
+		fmt.Printf("🗑️ Deleted stale partial upload on %s: %s\n", dest.Name(), rel)
+	}
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of a local file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compareSHA256 reads r to the end and checks that its SHA-256 equals sum.
+func compareSHA256(r io.Reader, sum []byte) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// remoteChecksum returns the checksum stored in the sidecar of rel, or "" if
+// there is none.
+func remoteChecksum(dest Destination, rel string) string {
+	r, err := dest.Get(rel + checksumSuffix)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
@@ -2,11 +2,65 @@ package backup
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-tool/utils"
 )
 
+// tempMarker is part of the names of files that are still being written, see
+// tempPattern.
+const tempMarker = ".tmp-"
+
+// staleTempAge is the age after which a temporary file is assumed to be left
+// by an interrupted run rather than being written by a concurrent one.
+const staleTempAge = 24 * time.Hour
+
+// tempPattern returns the os.CreateTemp pattern of a file that is written next
+// to the file name and renamed to it once complete, e.g. .name.tmp-123.
+func tempPattern(name string) string {
+	return "." + name + tempMarker + "*"
+}
+
+// isTempName reports whether name is a temporary file created with tempPattern.
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempMarker)
+}
+
+// RemoveStaleTemps deletes temporary files below localPath that interrupted
+// runs left behind. With dryRun they are only listed.
+func RemoveStaleTemps(localPath string, dryRun bool) error {
+	cutoff := time.Now().Add(-staleTempAge)
+	return filepath.WalkDir(localPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == localPath {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isTempName(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if dryRun {
+			fmt.Printf("🗑️ Would delete leftover temporary file: %s\n", path)
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Printf("⚠️ Failed to delete leftover temporary file %s: %v\n", path, err)
+			return nil
+		}
+		fmt.Printf("🗑️ Deleted leftover temporary file: %s\n", path)
+		return nil
+	})
+}
+
 func ensureBackupSubdir(root, category, subName string) (string, error) {
 	dirPath := filepath.Join(root, category, subName)
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
@@ -15,23 +69,32 @@ func ensureBackupSubdir(root, category, subName string) (string, error) {
 	return dirPath, nil
 }
 
-// runTar creates a tar.gz archive with specified contents.
-// targetArchive - path to the archive being created (must have .tar.gz extension)
-// baseDir - base directory for tar -C command
+// archiveFileName returns the name of a new archive, e.g. dir_20240101_120000.tar.zst.
+// The extension follows the compression, with .age or .enc appended when the
+// archive is encrypted.
+func archiveFileName(prefix string, opts ArchiveOptions) string {
+	return prefix + time.Now().Format(utils.TimestampLayout) + compressionExt(opts.Compression) + encryptionSuffix(opts.Encryption)
+}
+
+// runTar creates a compressed tar archive with specified contents.
+// targetArchive - path to the archive being created (must be named like a backup archive)
+// baseDir - base directory the entry is archived relative to (like tar -C)
 // entryName - name of file or directory to archive
-func runTar(targetArchive, baseDir, entryName string) error {
+// filter - optional include/exclude rules for directory trees (nil archives everything)
+// opts - compression and encryption settings for the archive
+func runTar(targetArchive, baseDir, entryName string, filter *pathFilter, opts ArchiveOptions) error {
 	// Check that target archive has correct extension
-	if filepath.Ext(targetArchive) != ".gz" {
-		return fmt.Errorf("archive must have .tar.gz extension, got: %s", targetArchive)
+	if !utils.IsArchiveName(filepath.Base(targetArchive)) {
+		return fmt.Errorf("archive must have a .tar, .tar.gz, .tar.zst or .tar.xz extension, got: %s", targetArchive)
 	}
 
-	cmd := exec.Command("tar", "-czf", targetArchive, "-C", baseDir, entryName)
-	
-	// Capture command output for more informative errors
-	output, err := cmd.CombinedOutput()
+	archive, err := createArchive(targetArchive, opts)
 	if err != nil {
-		return fmt.Errorf("tar execution error: %w, output: %s", err, string(output))
+		return err
+	}
+	if err := archive.addTree(baseDir, entryName, filter); err != nil {
+		archive.Abort()
+		return err
 	}
-	
-	return nil
+	return archive.Commit()
 }
@@ -0,0 +1,385 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+	"backup-tool/utils"
+)
+
+// validator collects the problems found in a configuration.
+type validator struct {
+	cfg      *config.Config
+	problems []config.Problem
+	dests    map[string]bool // destination names
+}
+
+// errorf records a problem that prevents a run.
+func (v *validator) errorf(path, format string, args ...any) {
+	v.problems = append(v.problems, config.Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// warnf records a problem the run works around.
+func (v *validator) warnf(path, format string, args ...any) {
+	v.problems = append(v.problems, config.Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// Validate checks cfg for mistakes that would otherwise only show up during a
+// run, such as unsupported types, missing userRef targets, invalid retention
+// and item names used twice, and returns all of them. With checkSources the
+// source paths of the items are checked as well.
+func Validate(cfg *config.Config, checkSources bool) []config.Problem {
+	v := &validator{cfg: cfg, dests: make(map[string]bool)}
+
+	if cfg.LocalBackupPath == "" {
+		v.errorf("localBackupPath", "missing")
+	} else if !filepath.IsAbs(cfg.LocalBackupPath) {
+		v.errorf("localBackupPath", "%q is not an absolute path", cfg.LocalBackupPath)
+	}
+	v.checkSize("maxTotalSize", cfg.MaxTotalSize)
+	v.checkCompression("compression", cfg.Compression)
+	v.checkEncryption("encryption", cfg.Encryption)
+
+	// Destinations first, so that retention overrides can refer to them
+	v.checkDestinations()
+
+	names := make(map[string]string) // item directory -> path of the item using it
+	for _, category := range []struct {
+		key, dir, kind string
+		items          []config.Item
+	}{
+		{"dirs", "dirs", "dir", cfg.Dirs},
+		{"files", "files", "file", cfg.Files},
+		{"logs", "logs", "log", cfg.Logs},
+	} {
+		for i, item := range category.items {
+			path := fmt.Sprintf("%s[%d]", category.key, i)
+			v.checkItem(path, category.kind, item, checkSources)
+			if item.Path != "" || item.Name != "" {
+				v.checkUnique(names, path, category.dir+"/"+item.BackupName())
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(cfg.DatabaseUsers) {
+		user, path := cfg.DatabaseUsers[name], "databaseUsers."+name
+		if user.Host == "" {
+			v.errorf(path+".host", "missing")
+		}
+		if user.Port <= 0 || user.Port > 65535 {
+			v.errorf(path+".port", "%d is not a valid port", user.Port)
+		}
+	}
+	for i, db := range cfg.Databases {
+		path := fmt.Sprintf("databases[%d]", i)
+		if db.Name == "" {
+			v.errorf(path+".name", "missing")
+		} else {
+			v.checkName(path+".name", db.Name)
+			v.checkUnique(names, path, "databases/"+db.Name)
+		}
+		if _, ok := dumpTools[strings.ToLower(db.Type)]; !ok {
+			v.errorf(path+".type", "unsupported database type %q (expected %s)", db.Type, strings.Join(sortedKeys(dumpTools), ", "))
+		}
+		if db.UserRef == "" {
+			v.errorf(path+".userRef", "missing")
+		} else if _, ok := cfg.DatabaseUsers[db.UserRef]; !ok {
+			v.errorf(path+".userRef", "databaseUsers has no entry %q", db.UserRef)
+		}
+		v.checkRetention(path, db.Lifetime, db.Keep, db.MinKeep, db.Retention)
+		v.checkCompression(path+".compression", db.Compression)
+	}
+
+	return v.problems
+}
+
+// checkItem checks a dir, file or log item.
+func (v *validator) checkItem(path, kind string, item config.Item, checkSources bool) {
+	if item.Name != "" {
+		v.checkName(path+".name", item.Name)
+	}
+	if item.Path == "" {
+		v.errorf(path+".path", "missing")
+	} else if !filepath.IsAbs(item.Path) {
+		v.errorf(path+".path", "%q is not an absolute path", item.Path)
+	} else if checkSources {
+		v.checkSource(path+".path", kind, item.Path)
+	}
+
+	v.checkRetention(path, item.Lifetime, item.Keep, item.MinKeep, item.Retention)
+	v.checkCompression(path+".compression", item.Compression)
+
+	switch strings.ToLower(item.Storage) {
+	case "", StorageArchive:
+	case StorageRepository:
+		if kind == "log" {
+			v.errorf(path+".storage", "logs cannot be stored in the repository")
+		}
+	default:
+		v.errorf(path+".storage", "unsupported storage %q (expected %s or %s)", item.Storage, StorageArchive, StorageRepository)
+	}
+
+	switch strings.ToLower(item.Mode) {
+	case "", ModeFull:
+	case ModeIncremental, ModeDifferential:
+		if kind != "dir" {
+			v.errorf(path+".mode", "%s backups are only supported for dirs", item.Mode)
+		}
+	default:
+		v.errorf(path+".mode", "unsupported mode %q (expected %s, %s or %s)", item.Mode, ModeFull, ModeIncremental, ModeDifferential)
+	}
+	if item.FullBackupDay != "" && !isWeekday(item.FullBackupDay) {
+		v.errorf(path+".fullBackupDay", "%q is not a day of the week", item.FullBackupDay)
+	}
+	if item.FullBackupInterval < 0 {
+		v.errorf(path+".fullBackupInterval", "must not be negative")
+	}
+}
+
+// checkSource checks that the source of an item exists and has the right kind.
+func (v *validator) checkSource(path, kind, source string) {
+	info, err := os.Stat(source)
+	switch {
+	case os.IsNotExist(err):
+		v.warnf(path, "%s does not exist (skipped by backups)", source)
+	case err != nil:
+		v.errorf(path, "cannot access %s: %v", source, err)
+	case kind == "dir" && !info.IsDir():
+		v.errorf(path, "%s is not a directory", source)
+	case kind != "dir" && info.IsDir():
+		v.errorf(path, "%s is a directory (use dirs)", source)
+	}
+}
+
+// checkRetention checks the lifetime, keep rules, minKeep and per-destination
+// retention of an item or database.
+func (v *validator) checkRetention(path string, lifetime int, keep config.Keep, minKeep *int, retention map[string]int) {
+	switch {
+	case lifetime < 0:
+		v.errorf(path+".lifetime", "must not be negative")
+	case lifetime == 0 && keep.IsZero():
+		v.errorf(path+".lifetime", "missing (set the number of days to keep backups, or keep rules)")
+	}
+	v.checkKeep(path, keep)
+	if minKeep != nil && *minKeep < 0 {
+		v.errorf(path+".minKeep", "must not be negative")
+	}
+	for _, dest := range sortedKeys(retention) {
+		if !v.dests[dest] {
+			v.errorf(path+".retention."+dest, "no destination is named %q", dest)
+		}
+		if retention[dest] <= 0 {
+			v.errorf(path+".retention."+dest, "must be at least 1 day")
+		}
+	}
+}
+
+// checkKeep checks that no keep rule is negative.
+func (v *validator) checkKeep(path string, keep config.Keep) {
+	for _, rule := range []struct {
+		key   string
+		count int
+	}{
+		{"keepLast", keep.Last},
+		{"keepDaily", keep.Daily},
+		{"keepWeekly", keep.Weekly},
+		{"keepMonthly", keep.Monthly},
+		{"keepYearly", keep.Yearly},
+	} {
+		if rule.count < 0 {
+			v.errorf(joinPath(path, rule.key), "must not be negative")
+		}
+	}
+}
+
+// checkName checks that name can be used as a directory name.
+func (v *validator) checkName(path, name string) {
+	if name == "." || name == ".." || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		v.errorf(path, "%q cannot be used as a directory name", name)
+	}
+}
+
+// checkUnique records that the item at path stores its backups in dir and
+// reports an error if another item does so already.
+func (v *validator) checkUnique(names map[string]string, path, dir string) {
+	if other, ok := names[dir]; ok {
+		v.errorf(path, "backups would be stored in %s, like those of %s (set a different name)", dir, other)
+		return
+	}
+	names[dir] = path
+}
+
+// checkCompression checks a compression block.
+func (v *validator) checkCompression(path string, c *config.Compression) {
+	if c == nil {
+		return
+	}
+	switch strings.ToLower(c.Type) {
+	case "", CompressionGzip, CompressionZstd, CompressionXz, CompressionNone:
+	default:
+		v.errorf(path+".type", "unsupported compression %q (expected %s, %s, %s or %s)",
+			c.Type, CompressionGzip, CompressionZstd, CompressionXz, CompressionNone)
+	}
+	if c.Level != nil {
+		levels := map[string][2]int{"": {0, 9}, CompressionGzip: {0, 9}, CompressionZstd: {1, 22}, CompressionXz: {0, 9}}
+		if r, ok := levels[strings.ToLower(c.Type)]; ok && (*c.Level < r[0] || *c.Level > r[1]) {
+			v.errorf(path+".level", "%d is out of range for %s (expected %d-%d)", *c.Level, compressionType(c), r[0], r[1])
+		}
+		if strings.ToLower(c.Type) == CompressionNone {
+			v.warnf(path+".level", "ignored without compression")
+		}
+	}
+	if c.Threads < 0 {
+		v.errorf(path+".threads", "must not be negative")
+	}
+}
+
+// checkEncryption checks the encryption block.
+func (v *validator) checkEncryption(path string, enc *config.Encryption) {
+	if enc == nil {
+		return
+	}
+	switch strings.ToLower(enc.Type) {
+	case EncryptionAge:
+		if len(enc.Recipients) == 0 {
+			v.errorf(path+".recipients", "missing (age encryption needs at least one recipient)")
+		}
+	case EncryptionPassphrase:
+		if !enc.Passphrase.IsSet() {
+			v.errorf(path+".passphrase", "missing")
+		}
+	default:
+		v.errorf(path+".type", "unsupported encryption %q (expected %s or %s)", enc.Type, EncryptionAge, EncryptionPassphrase)
+	}
+}
+
+// checkSize checks a size such as maxTotalSize, if set.
+func (v *validator) checkSize(path, size string) {
+	if size == "" {
+		return
+	}
+	if _, err := utils.ParseSize(size); err != nil {
+		v.errorf(path, "%v", err)
+	}
+}
+
+// checkDestinations checks the destinations and the legacy upload block and
+// records their names.
+func (v *validator) checkDestinations() {
+	cfg := v.cfg
+	for i, dest := range cfg.Destinations {
+		path := fmt.Sprintf("destinations[%d]", i)
+		name := dest.Name
+		if name == "" {
+			name = dest.Type
+		}
+		if v.dests[name] {
+			v.errorf(path+".name", "another destination is named %q", name)
+		}
+		v.dests[name] = true
+
+		if dest.Lifetime < 0 {
+			v.errorf(path+".lifetime", "must not be negative")
+		}
+		v.checkKeep(path, dest.Keep)
+		if dest.MinKeep != nil && *dest.MinKeep < 0 {
+			v.errorf(path+".minKeep", "must not be negative")
+		}
+		v.checkSize(path+".maxTotalSize", dest.MaxTotalSize)
+
+		switch strings.ToLower(dest.Type) {
+		case DestinationSMB:
+			if dest.SMB == nil {
+				v.errorf(path+".smb", "missing")
+				continue
+			}
+			v.required(path+".smb.host", dest.SMB.Host)
+			v.required(path+".smb.share", dest.SMB.Share)
+		case DestinationS3:
+			if dest.S3 == nil {
+				v.errorf(path+".s3", "missing")
+				continue
+			}
+			v.required(path+".s3.endpoint", dest.S3.Endpoint)
+			v.required(path+".s3.bucket", dest.S3.Bucket)
+		case DestinationSFTP:
+			if dest.SFTP == nil {
+				v.errorf(path+".sftp", "missing")
+				continue
+			}
+			v.required(path+".sftp.host", dest.SFTP.Host)
+			v.required(path+".sftp.user", dest.SFTP.User)
+		case DestinationWebDAV:
+			if dest.WebDAV == nil {
+				v.errorf(path+".webdav", "missing")
+				continue
+			}
+			v.required(path+".webdav.url", dest.WebDAV.URL)
+		case DestinationLocal:
+			if dest.Local == nil {
+				v.errorf(path+".local", "missing")
+				continue
+			}
+			v.required(path+".local.path", dest.Local.Path)
+			if dest.Local.Path != "" && !filepath.IsAbs(dest.Local.Path) {
+				v.errorf(path+".local.path", "%q is not an absolute path", dest.Local.Path)
+			}
+		default:
+			v.errorf(path+".type", "unsupported destination type %q (expected %s, %s, %s, %s or %s)",
+				dest.Type, DestinationSMB, DestinationS3, DestinationSFTP, DestinationWebDAV, DestinationLocal)
+		}
+	}
+
+	if cfg.Upload.Active {
+		if v.dests[DestinationSMB] {
+			v.errorf("upload", "a destination is already named %q, which the active upload block uses", DestinationSMB)
+		}
+		v.dests[DestinationSMB] = true
+		v.required("upload.smbhost", cfg.Upload.SMBHost)
+		v.required("upload.smbshare", cfg.Upload.SMBShare)
+		if cfg.Upload.Lifetime < 0 {
+			v.errorf("upload.lifetime", "must not be negative")
+		}
+	}
+}
+
+// required reports a missing value.
+func (v *validator) required(path, value string) {
+	if value == "" {
+		v.errorf(path, "missing")
+	}
+}
+
+// isWeekday reports whether day names a day of the week, e.g. "sunday".
+func isWeekday(day string) bool {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), day) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// joinPath appends a key to a JSON path.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
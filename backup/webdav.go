@@ -0,0 +1,406 @@
+// Package backup
+package backup
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-tool/config"
+)
+
+// defaultWebDAVChunkSize is the chunk size in MiB of Nextcloud chunked uploads
+// if none is configured.
+const defaultWebDAVChunkSize = 10
+
+// webdavClient is the HTTP client of WebDAV destinations. Transfers of whole
+// archives may take hours, so requests have no overall deadline; connecting
+// and waiting for a response are limited instead (the response to the final
+// MOVE of a chunked upload can take a while as the server assembles the file).
+var webdavClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Minute,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	},
+}
+
+// propfindBody requests the properties List and Stat need.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// webdavDestination stores backups in a WebDAV collection.
+type webdavDestination struct {
+	name    string
+	client  *http.Client
+	base    *url.URL // collection the backup tree is stored under
+	uploads *url.URL // Nextcloud uploads collection, nil if chunking is disabled
+	chunk   int64    // chunk size in bytes
+	cfg     config.WebDAVDestination
+	verify  bool            // read uploads back and compare their SHA-256 before renaming
+	dirs    map[string]bool // collections known to exist
+}
+
+// davMultistatus is the PROPFIND response.
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// openWebDAVDestination checks that the collection described by cfg is reachable.
+func openWebDAVDestination(name string, cfg config.WebDAVDestination, verify bool) (*webdavDestination, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid WebDAV URL %q", cfg.URL)
+	}
+
+	d := &webdavDestination{
+		name:   name,
+		client: webdavClient,
+		base:   base,
+		cfg:    cfg,
+		verify: verify,
+		dirs:   make(map[string]bool),
+	}
+	if cfg.UploadsURL != "" {
+		if d.uploads, err = url.Parse(strings.TrimSuffix(cfg.UploadsURL, "/")); err != nil || d.uploads.Host == "" {
+			return nil, fmt.Errorf("invalid WebDAV uploads URL %q", cfg.UploadsURL)
+		}
+		chunk := cfg.ChunkSize
+		if chunk <= 0 {
+			chunk = defaultWebDAVChunkSize
+		}
+		d.chunk = int64(chunk) << 20
+	}
+
+	info, err := d.Stat(".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to access WebDAV collection %s: %w", cfg.URL, err)
+	}
+	if !info.IsDir {
+		return nil, fmt.Errorf("WebDAV URL %s is not a collection", cfg.URL)
+	}
+	d.dirs["."] = true
+	return d, nil
+}
+
+// url returns the URL of rel.
+func (d *webdavDestination) url(rel string) string {
+	if rel == "." || rel == "" {
+		return d.base.String()
+	}
+	return d.base.JoinPath(strings.Split(rel, "/")...).String()
+}
+
+// do sends a request with the configured credentials. size is the length of
+// body, or -1 to send it with chunked transfer encoding.
+func (d *webdavDestination) do(method, target string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	// A non-nil body with ContentLength 0 means an unknown length, which would
+	// be sent chunked; some servers reject that for empty uploads
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if d.cfg.User != "" {
+		req.SetBasicAuth(d.cfg.User, d.cfg.Password.Value)
+	}
+	return d.client.Do(req)
+}
+
+// call sends a request and returns an error unless the response status is
+// one of ok. The response body is discarded.
+func (d *webdavDestination) call(method, target string, body io.Reader, size int64, header http.Header, ok ...int) (int, error) {
+	resp, err := d.do(method, target, body, size, header)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp.StatusCode, nil
+		}
+	}
+	return resp.StatusCode, fmt.Errorf("%s %s: %s", method, target, resp.Status)
+}
+
+// mkdirAll creates the collection rel and its parents.
+func (d *webdavDestination) mkdirAll(rel string) error {
+	if rel == "." || d.dirs[rel] {
+		return nil
+	}
+	if err := d.mkdirAll(path.Dir(rel)); err != nil {
+		return err
+	}
+	// 405 Method Not Allowed: the collection already exists
+	if _, err := d.call("MKCOL", d.url(rel), nil, 0, nil, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+		return fmt.Errorf("failed to create directory %s on WebDAV: %w", rel, err)
+	}
+	d.dirs[rel] = true
+	return nil
+}
+
+// move renames src (a full URL) to rel, replacing an existing file unless
+// header sets Overwrite to F.
+func (d *webdavDestination) move(src, rel string, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Destination", d.url(rel))
+	if header.Get("Overwrite") == "" {
+		header.Set("Overwrite", "T")
+	}
+	_, err := d.call("MOVE", src, nil, 0, header, http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+// Name implements Destination.
+func (d *webdavDestination) Name() string { return d.name }
+
+// Put implements Destination. The data is uploaded to a temporary .partial
+// name, either with a single streamed PUT or, for large files on Nextcloud, in
+// chunks that are assembled by the server; it is checked (size, and SHA-256
+// if verify is set) and then moved to its final name.
+func (d *webdavDestination) Put(rel string, r io.Reader, size int64) error {
+	if err := d.mkdirAll(path.Dir(rel)); err != nil {
+		return err
+	}
+
+	tmpPath := partialName(rel)
+	hash := sha256.New()
+	tr := io.TeeReader(r, hash)
+	var err error
+	if d.uploads != nil && size > d.chunk {
+		err = d.putChunked(tmpPath, tr, size)
+	} else {
+		_, err = d.call(http.MethodPut, d.url(tmpPath), tr, size, nil, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	}
+	if err != nil {
+		d.Delete(tmpPath)
+		return fmt.Errorf("error copying %s to WebDAV: %w", rel, err)
+	}
+
+	if err := d.verifyUpload(tmpPath, size, hash.Sum(nil)); err != nil {
+		d.Delete(tmpPath)
+		return fmt.Errorf("verification of %s on WebDAV failed: %w", rel, err)
+	}
+
+	if err := d.move(d.url(tmpPath), rel, nil); err != nil {
+		d.Delete(tmpPath)
+		return fmt.Errorf("failed to rename %s to %s on WebDAV: %w", tmpPath, rel, err)
+	}
+	return nil
+}
+
+// putChunked uploads r with the Nextcloud chunking protocol: the chunks are
+// stored in a temporary upload collection and assembled into rel by moving
+// its .file entry.
+func (d *webdavDestination) putChunked(rel string, r io.Reader, size int64) error {
+	id := make([]byte, 8)
+	rand.Read(id)
+	upload := d.uploads.JoinPath("backup-" + hex.EncodeToString(id))
+
+	// Nextcloud requires the final location on every request of the upload
+	header := http.Header{}
+	header.Set("Destination", d.url(rel))
+
+	if _, err := d.call("MKCOL", upload.String(), nil, 0, header, http.StatusCreated); err != nil {
+		return err
+	}
+
+	for n, offset := 1, int64(0); offset < size; n++ {
+		length := min(d.chunk, size-offset)
+		chunk := upload.JoinPath(fmt.Sprintf("%05d", n)).String()
+		if _, err := d.call(http.MethodPut, chunk, io.LimitReader(r, length), length, header, http.StatusCreated, http.StatusNoContent); err != nil {
+			d.call(http.MethodDelete, upload.String(), nil, 0, nil, http.StatusNoContent, http.StatusOK)
+			return err
+		}
+		offset += length
+	}
+
+	header.Set("OC-Total-Length", strconv.FormatInt(size, 10))
+	if err := d.move(upload.JoinPath(".file").String(), rel, header); err != nil {
+		d.call(http.MethodDelete, upload.String(), nil, 0, nil, http.StatusNoContent, http.StatusOK)
+		return err
+	}
+	return nil
+}
+
+// verifyUpload checks that an uploaded file has the expected size and, if
+// verify is set, reads it back to compare its SHA-256 with sum.
+func (d *webdavDestination) verifyUpload(rel string, size int64, sum []byte) error {
+	info, err := d.Stat(rel)
+	if err != nil {
+		return err
+	}
+	if info.Size != size {
+		return fmt.Errorf("size is %d bytes, expected %d", info.Size, size)
+	}
+	if !d.verify {
+		return nil
+	}
+
+	f, err := d.Get(rel)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return compareSHA256(f, sum)
+}
+
+// propfind returns rel itself and, with depth 1, its members. The entry of rel
+// is recognized by its href, since servers return the entries in any order.
+func (d *webdavDestination) propfind(rel, depth string) (RemoteFile, []RemoteFile, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := d.do("PROPFIND", d.url(rel), strings.NewReader(propfindBody), int64(len(propfindBody)), header)
+	if err != nil {
+		return RemoteFile{}, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return RemoteFile{}, nil, &os.PathError{Op: "propfind", Path: rel, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return RemoteFile{}, nil, fmt.Errorf("PROPFIND %s: %s", d.url(rel), resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return RemoteFile{}, nil, fmt.Errorf("invalid PROPFIND response for %s: %w", rel, err)
+	}
+
+	selfPath := strings.TrimSuffix(d.base.JoinPath(rel).Path, "/")
+	var self RemoteFile
+	found := false
+	var files []RemoteFile
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		p := strings.TrimSuffix(href.Path, "/")
+		f := RemoteFile{Name: path.Base(p)}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			f.IsDir = ps.Prop.ResourceType.Collection != nil
+			f.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			f.ModTime, _ = time.Parse(http.TimeFormat, ps.Prop.LastModified)
+		}
+		// With depth 0 the only entry is rel, whatever href the server uses
+		if p == selfPath || depth == "0" && len(ms.Responses) == 1 {
+			self, found = f, true
+			continue
+		}
+		files = append(files, f)
+	}
+	if !found {
+		return RemoteFile{}, nil, fmt.Errorf("PROPFIND response for %s does not include it", rel)
+	}
+	return self, files, nil
+}
+
+// List implements Destination.
+func (d *webdavDestination) List(rel string) ([]RemoteFile, error) {
+	_, files, err := d.propfind(rel, "1")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s on WebDAV: %w", rel, err)
+	}
+	return files, nil
+}
+
+// Stat implements Destination.
+func (d *webdavDestination) Stat(rel string) (RemoteFile, error) {
+	info, _, err := d.propfind(rel, "0")
+	if os.IsNotExist(err) {
+		return RemoteFile{}, err
+	}
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("failed to stat %s on WebDAV: %w", rel, err)
+	}
+	return info, nil
+}
+
+// Delete implements Destination.
+func (d *webdavDestination) Delete(rel string) error {
+	_, err := d.call(http.MethodDelete, d.url(rel), nil, 0, nil, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+// Move implements Destination.
+func (d *webdavDestination) Move(from, to string) error {
+	if err := d.mkdirAll(path.Dir(to)); err != nil {
+		return err
+	}
+	// Unlike uploads, moves must not replace an existing file
+	header := http.Header{}
+	header.Set("Overwrite", "F")
+	if err := d.move(d.url(from), to, header); err != nil {
+		return fmt.Errorf("failed to move %s to %s on WebDAV: %w", from, to, err)
+	}
+	return nil
+}
+
+// Get implements Destination.
+func (d *webdavDestination) Get(rel string) (io.ReadCloser, error) {
+	resp, err := d.do(http.MethodGet, d.url(rel), nil, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s on WebDAV: %w", rel, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: rel, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to open %s on WebDAV: %s", rel, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Close implements Destination.
+func (d *webdavDestination) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
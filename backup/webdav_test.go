@@ -0,0 +1,147 @@
+// Package backup
+package backup
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backup-tool/config"
+	"golang.org/x/net/webdav"
+)
+
+// newTestWebDAVDestination serves a temporary directory over WebDAV below
+// /dav and returns a destination storing in its Backups collection.
+func newTestWebDAVDestination(t *testing.T) (*webdavDestination, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "Backups"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	})
+	t.Cleanup(server.Close)
+
+	dest, err := openWebDAVDestination("webdav", config.WebDAVDestination{URL: server.URL + "/dav/Backups"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest, dir
+}
+
+func TestWebDAVDestination(t *testing.T) {
+	dest, dir := newTestWebDAVDestination(t)
+	content := "archive content"
+	if err := dest.Put("dirs/my www/dir_20260101_000000.tar.gz", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	files, err := dest.List("dirs/my www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "dir_20260101_000000.tar.gz" || files[0].Size != int64(len(content)) {
+		t.Fatalf("List = %+v, want only the uploaded archive", files)
+	}
+	if files, err := dest.List("dirs/missing"); err != nil || len(files) != 0 {
+		t.Errorf("List of a missing collection = %+v, %v; want no entries", files, err)
+	}
+
+	if err := dest.Move("dirs/my www/dir_20260101_000000.tar.gz", "dirs/www/dir_20260101_000000.tar.gz"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "Backups/dirs/www/dir_20260101_000000.tar.gz"))
+	if err != nil || string(data) != content {
+		t.Errorf("moved file = %q, %v; want %q", data, err, content)
+	}
+	if err := dest.Put("dirs/my www/dir_20260102_000000.tar.gz", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Move("dirs/my www/dir_20260102_000000.tar.gz", "dirs/www/dir_20260101_000000.tar.gz"); err == nil {
+		t.Error("Move onto an existing file succeeded")
+	}
+
+	r, err := dest.Get("dirs/www/dir_20260101_000000.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != content {
+		t.Errorf("Get = %q, %v; want %q", data, err, content)
+	}
+
+	if err := dest.Delete("dirs/www/dir_20260101_000000.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dest.Stat("dirs/www/dir_20260101_000000.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("file still exists after Delete: %v", err)
+	}
+}
+
+func TestWebDAVDestinationListFindsCollectionByHref(t *testing.T) {
+	// The collection is listed last and its href is percent-encoded differently
+	// from the request and has a trailing slash
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		entry := func(href, resourceType, length string) string {
+			return fmt.Sprintf(`<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype>%s</d:resourcetype><d:getcontentlength>%s</d:getcontentlength></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, href, resourceType, length)
+		}
+		if r.Header.Get("Depth") == "0" {
+			fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">%s</d:multistatus>`, entry(r.URL.Path, "<d:collection/>", ""))
+			return
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">%s%s%s</d:multistatus>`,
+			entry("/dav/dirs/my%20www/dir_20260101_000000.tar.gz", "", "10"),
+			entry("/dav/dirs/my%20www/.index/", "<d:collection/>", ""),
+			entry("/dav/dirs/my%20www/", "<d:collection/>", ""))
+	}))
+	defer server.Close()
+
+	dest, err := openWebDAVDestination("webdav", config.WebDAVDestination{URL: server.URL + "/dav"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := dest.List("dirs/my www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "dir_20260101_000000.tar.gz" || files[0].Size != 10 || files[1].Name != ".index" || !files[1].IsDir {
+		t.Errorf("List = %+v, want the archive and .index", files)
+	}
+}
+
+func TestWebDAVDestinationPutEmptyFile(t *testing.T) {
+	dir := t.TempDir()
+	handler := &webdav.Handler{FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+	var chunked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && (len(r.TransferEncoding) > 0 || r.ContentLength != 0) {
+			chunked = append(chunked, r.URL.Path)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	dest, err := openWebDAVDestination("webdav", config.WebDAVDestination{URL: server.URL}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Put("logs/app/log_20260101_000000.tar.gz", strings.NewReader(""), 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if len(chunked) > 0 {
+		t.Errorf("empty uploads sent without Content-Length: 0: %v", chunked)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "logs/app/log_20260101_000000.tar.gz")); err != nil || info.Size() != 0 {
+		t.Errorf("uploaded file = %v, %v; want an empty file", info, err)
+	}
+}
@@ -1,7 +1,17 @@
 // Package config
 package config
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+)
+
 type Config struct {
+	// Include lists files or glob patterns (relative to this file) whose
+	// dirs, databases, ... are merged into this configuration, see Load
+	Include         []string          `json:"include,omitempty"`
 	LocalBackupPath string            `json:"localBackupPath"`
 	Dirs            []Item            `json:"dirs"`
 	Files           []Item            `json:"files"`
@@ -9,17 +19,78 @@ type Config struct {
 	DatabaseUsers   map[string]DBUser `json:"databaseUsers,omitempty"`
 	Databases       []Database        `json:"databases"`
 	Upload          Upload            `json:"upload"`
+	// Destinations are remote copies of localBackupPath; an active Upload
+	// block is treated as an additional SMB destination
+	Destinations []Destination `json:"destinations,omitempty"`
+	Encryption   *Encryption   `json:"encryption,omitempty"`
+	// Compression is the default for all items; items may override it
+	Compression *Compression `json:"compression,omitempty"`
+	// MaxTotalSize caps the size of LocalBackupPath (e.g. "200G"); the oldest
+	// archives are deleted after the run until it fits
+	MaxTotalSize string `json:"maxTotalSize,omitempty"`
+
+	origins map[string]string // merged path -> fragment and path, see Locate
 }
 
 type Item struct {
-	Path     string `json:"path"`
+	Path string `json:"path"`
+	// Name is the directory the item's backups are stored in (default: Path
+	// as a slug, see BackupName)
+	Name     string `json:"name,omitempty"`
 	Lifetime int    `json:"lifetime"`
+	// Keep adds grandfather-father-son rules (keepLast, keepDaily, ...) to Lifetime
+	Keep
+	// MinKeep is the number of backups never deleted by retention (default 3, 0 disables)
+	MinKeep *int `json:"minKeep,omitempty"`
+	// Exclude and Include hold gitignore-style patterns relative to Path (dirs only)
+	Exclude []string `json:"exclude,omitempty"`
+	Include []string `json:"include,omitempty"`
+	// Storage is archive (default, one tar.gz per run) or repository
+	// (deduplicated chunks with a snapshot per run, dirs and files only)
+	Storage string `json:"storage,omitempty"`
+	// Mode is full (default), incremental or differential (dirs only).
+	// In the latter two a full backup is taken on FullBackupDay (e.g. "sunday")
+	// and/or every FullBackupInterval days (7 if neither is set).
+	Mode               string `json:"mode,omitempty"`
+	FullBackupDay      string `json:"fullBackupDay,omitempty"`
+	FullBackupInterval int    `json:"fullBackupInterval,omitempty"`
+	// Compression overrides the global compression setting for this item
+	Compression *Compression `json:"compression,omitempty"`
+	// Retention overrides Lifetime on destinations: days to keep by destination name
+	Retention map[string]int `json:"retention,omitempty"`
+}
+
+// BackupName returns the name of the directory the item's backups are stored
+// in: Name if set, otherwise Path without the leading slash and with "_" for
+// separators, e.g. var_www_html for /var/www/html. Paths that contain "_"
+// themselves get a short hash of the path appended (/srv/my_app becomes
+// srv_my_app-2ea3324d), so /a/b_c and /a_b/c do not share a directory.
+func (i Item) BackupName() string {
+	if i.Name != "" {
+		return i.Name
+	}
+	clean := filepath.ToSlash(filepath.Clean(i.Path))
+	slug := strings.Trim(clean, "/")
+	if slug == "" || slug == "." {
+		return "_root"
+	}
+	if strings.Contains(slug, "_") {
+		sum := sha256.Sum256([]byte(clean))
+		slug += "-" + hex.EncodeToString(sum[:4])
+	}
+	return strings.ReplaceAll(slug, "/", "_")
+}
+
+// LegacyName returns the directory backups of the item were stored in before
+// items had names: the base name of Path.
+func (i Item) LegacyName() string {
+	return filepath.Base(i.Path)
 }
 
 // DBUser contains common database connection parameters
 type DBUser struct {
 	User     string `json:"user"`
-	Password string `json:"password"`
+	Password Secret `json:"password"`
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 }
@@ -30,13 +101,174 @@ type Database struct {
 	Type     string `json:"type"`    // postgres, mysql, mongo
 	UserRef  string `json:"userRef"` // reference to key in DatabaseUsers
 	Lifetime int    `json:"lifetime"`
+	Keep
+	MinKeep *int `json:"minKeep,omitempty"` // as in Item
+	// Compression overrides the global compression setting for this database
+	Compression *Compression `json:"compression,omitempty"`
+	// Retention overrides Lifetime on destinations: days to keep by destination name
+	Retention map[string]int `json:"retention,omitempty"`
+}
+
+// Keep is a grandfather-father-son retention policy. In addition to the
+// backups younger than the lifetime, the newest Last backups are kept, as well
+// as the newest backup of each of the last Daily days, Weekly ISO weeks,
+// Monthly months and Yearly years that have a backup.
+type Keep struct {
+	Last    int `json:"keepLast,omitempty"`
+	Daily   int `json:"keepDaily,omitempty"`
+	Weekly  int `json:"keepWeekly,omitempty"`
+	Monthly int `json:"keepMonthly,omitempty"`
+	Yearly  int `json:"keepYearly,omitempty"`
+}
+
+// IsZero reports whether no keep rule is set.
+func (k Keep) IsZero() bool {
+	return k == Keep{}
+}
+
+// Compression selects how archives are compressed.
+// Type is gzip (default), zstd, xz or none. Level is the level of the format
+// (the default if not set; 0 is xz preset 0 and uncompressed gzip); Threads
+// limits parallel compression (gzip and zstd, 0 = all CPUs).
+type Compression struct {
+	Type    string `json:"type"`
+	Level   *int   `json:"level,omitempty"`
+	Threads int    `json:"threads,omitempty"`
+}
+
+// Encryption configures client-side encryption of archives and repository chunks.
+// Type is "age" (encrypt to Recipients, decrypt with IdentityFile) or
+// "passphrase" (AES-256-GCM with a key derived from Passphrase via scrypt).
+type Encryption struct {
+	Type         string   `json:"type"`
+	Recipients   []string `json:"recipients,omitempty"`
+	IdentityFile string   `json:"identityFile,omitempty"`
+	Passphrase   Secret   `json:"passphrase,omitempty"`
 }
 
 type Upload struct {
 	Active      bool   `json:"active"`
 	SMBUser     string `json:"smbuser"`
-	SMBPassword string `json:"smbpassword"`
+	SMBPassword Secret `json:"smbpassword"`
 	SMBHost     string `json:"smbhost"`
 	SMBShare    string `json:"smbshare"`
-	Domain    string `json:"domain"`
+	Domain      string `json:"domain"`
+	// Checksum stores a SHA-256 sidecar (<file>.sha256) next to every uploaded
+	// file; files are then only skipped if size and checksum both match
+	Checksum bool `json:"checksum,omitempty"`
+	// Verify reads every uploaded file back and compares its SHA-256 before
+	// it is renamed from its temporary .partial name
+	Verify bool `json:"verify,omitempty"`
+	// Lifetime is the number of days archives are kept on the share
+	// (default: the lifetime of each item)
+	Lifetime int `json:"lifetime,omitempty"`
+}
+
+// Destination is a remote location the backup tree is mirrored to.
+// Type selects the backend and which of the backend blocks is used.
+type Destination struct {
+	Name string `json:"name"` // used in logs and by restore (default: the type)
+	Type string `json:"type"` // smb, s3, sftp, webdav or local
+	// Checksum and Verify work as in Upload
+	Checksum bool `json:"checksum,omitempty"`
+	Verify   bool `json:"verify,omitempty"`
+	// Lifetime and Keep are the retention on this destination (default: the
+	// lifetime and keep rules of each item); items may override it in Retention
+	Lifetime int `json:"lifetime,omitempty"`
+	Keep
+	// MinKeep overrides the minKeep of the items on this destination
+	MinKeep *int `json:"minKeep,omitempty"`
+	// MaxTotalSize caps the size of everything stored on this destination
+	MaxTotalSize string `json:"maxTotalSize,omitempty"`
+
+	SMB    *SMBDestination    `json:"smb,omitempty"`
+	S3     *S3Destination     `json:"s3,omitempty"`
+	SFTP   *SFTPDestination   `json:"sftp,omitempty"`
+	WebDAV *WebDAVDestination `json:"webdav,omitempty"`
+	Local  *LocalDestination  `json:"local,omitempty"`
+}
+
+// SMBDestination holds the connection parameters of an SMB share.
+type SMBDestination struct {
+	User     string `json:"user"`
+	Password Secret `json:"password"`
+	Host     string `json:"host"`
+	Share    string `json:"share"`
+	Domain   string `json:"domain,omitempty"`
+}
+
+// S3Destination describes a bucket on S3 or an S3-compatible service (MinIO).
+// If AccessKey/SecretKey are empty, credentials are taken from the environment
+// (AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or MINIO_ROOT_USER/MINIO_ROOT_PASSWORD).
+type S3Destination struct {
+	Endpoint     string `json:"endpoint"` // e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region       string `json:"region,omitempty"`
+	Bucket       string `json:"bucket"`
+	Prefix       string `json:"prefix,omitempty"` // key prefix the backup tree is stored under
+	AccessKey    string `json:"accessKey,omitempty"`
+	SecretKey    Secret `json:"secretKey,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"` // e.g. STANDARD_IA, GLACIER
+	PartSize     int    `json:"partSize,omitempty"`     // multipart part size in MiB (default 64)
+}
+
+// SFTPDestination describes a directory on an SSH host. Authentication uses
+// KeyFile if set, Password otherwise; the host key must be listed in KnownHosts.
+type SFTPDestination struct {
+	Host          string `json:"host"`
+	Port          int    `json:"port,omitempty"` // default 22
+	User          string `json:"user"`
+	Password      Secret `json:"password,omitempty"`
+	KeyFile       string `json:"keyFile,omitempty"`       // private key in OpenSSH/PEM format
+	KeyPassphrase Secret `json:"keyPassphrase,omitempty"` // for an encrypted KeyFile
+	KnownHosts    string `json:"knownHosts,omitempty"`    // default ~/.ssh/known_hosts
+	Path          string `json:"path,omitempty"`          // remote directory the backup tree is stored under (default: login directory)
+}
+
+// WebDAVDestination describes a WebDAV collection, e.g. a Nextcloud folder
+// (https://cloud.example.com/remote.php/dav/files/<user>/Backups).
+type WebDAVDestination struct {
+	URL      string `json:"url"` // collection the backup tree is stored under
+	User     string `json:"user,omitempty"`
+	Password Secret `json:"password,omitempty"`
+	// UploadsURL enables Nextcloud chunked uploads for files larger than
+	// ChunkSize, e.g. https://cloud.example.com/remote.php/dav/uploads/<user>
+	UploadsURL string `json:"uploadsUrl,omitempty"`
+	ChunkSize  int    `json:"chunkSize,omitempty"` // chunk size in MiB (default 10)
+}
+
+// LocalDestination describes a directory on a mounted filesystem (NFS, USB disk).
+type LocalDestination struct {
+	Path string `json:"path"` // directory the backup tree is mirrored to
+	// Hardlink links archives instead of copying them when Path is on the
+	// same filesystem as localBackupPath (falls back to copying)
+	Hardlink bool `json:"hardlink,omitempty"`
+}
+
+// RemoteDestinations returns the configured destinations, with the legacy
+// upload block appended as a destination named "smb" if it is active.
+func (c *Config) RemoteDestinations() []Destination {
+	dests := make([]Destination, 0, len(c.Destinations)+1)
+	for _, d := range c.Destinations {
+		if d.Name == "" {
+			d.Name = d.Type
+		}
+		dests = append(dests, d)
+	}
+	if c.Upload.Active {
+		dests = append(dests, Destination{
+			Name:     "smb",
+			Type:     "smb",
+			Checksum: c.Upload.Checksum,
+			Verify:   c.Upload.Verify,
+			Lifetime: c.Upload.Lifetime,
+			SMB: &SMBDestination{
+				User:     c.Upload.SMBUser,
+				Password: c.Upload.SMBPassword,
+				Host:     c.Upload.SMBHost,
+				Share:    c.Upload.SMBShare,
+				Domain:   c.Upload.Domain,
+			},
+		})
+	}
+	return dests
 }
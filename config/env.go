@@ -0,0 +1,171 @@
+// Package config
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// ExpandEnv replaces environment variable references in every string field of
+// the configuration:
+//
+//	${VAR}          value of VAR, empty if unset
+//	${VAR:-default} value of VAR, or default if VAR is unset or empty
+//	${VAR:?message} value of VAR; an error if VAR is unset or empty
+//	$${             a literal "${"
+//
+// Errors name the field by its JSON path, e.g. databaseUsers.pg.password.
+func (c *Config) ExpandEnv() error {
+	return walkConfig(reflect.ValueOf(c).Elem(), "", func(v reflect.Value, path string) error {
+		if v.Kind() != reflect.String {
+			return nil
+		}
+		s, err := expandString(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(s)
+		return nil
+	})
+}
+
+// walkConfig calls visit for v, found at path, and for every value nested in
+// it. Values are settable; map elements are visited as copies that are
+// stored back afterwards.
+func walkConfig(v reflect.Value, path string, visit func(v reflect.Value, path string) error) error {
+	if err := visit(v, path); err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return walkConfig(v.Elem(), path, visit)
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			// Embedded structs and fields not in the JSON (Secret.Value)
+			// share the path of their parent
+			fieldPath := path
+			if name := jsonName(field); !field.Anonymous && name != "-" {
+				fieldPath = joinPath(path, name)
+			}
+			if err := walkConfig(v.Field(i), fieldPath, visit); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkConfig(v.Index(i), fmt.Sprintf("%s[%d]", path, i), visit); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			if err := walkConfig(elem, joinPath(path, fmt.Sprint(iter.Key())), visit); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+	return nil
+}
+
+// expandString expands the ${...} references in s.
+func expandString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			// $${ is an escaped ${
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			// The value is left out of errors, it may be a secret
+			return "", errors.New(`unterminated "${" (write "$${" for a literal "${")`)
+		}
+		value, err := lookupRef(s[i+2 : i+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// lookupRef resolves the inside of one ${...} reference.
+func lookupRef(ref string) (string, error) {
+	name, op, arg := ref, "", ""
+	if i := strings.Index(ref, ":"); i >= 0 {
+		name, op, arg = ref[:i], ref[i:min(i+2, len(ref))], ref[min(i+2, len(ref)):]
+	}
+	if name == "" {
+		return "", errors.New(`empty variable name in "${...}"`)
+	}
+
+	value := os.Getenv(name)
+	switch op {
+	case "":
+		return value, nil
+	case ":-":
+		if value == "" {
+			return arg, nil
+		}
+		return value, nil
+	case ":?":
+		if value == "" {
+			if arg == "" {
+				arg = "not set"
+			}
+			return "", fmt.Errorf("required variable %s: %s", name, arg)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported reference to %s (use ${VAR}, ${VAR:-default} or ${VAR:?message})", name)
+	}
+}
+
+// jsonName returns the name of a struct field in the JSON configuration, or
+// "-" if it is not part of it.
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// joinPath appends a field name to a JSON path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
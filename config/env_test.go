@@ -0,0 +1,62 @@
+// Package config
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandString(t *testing.T) {
+	t.Setenv("BT_USER", "backup")
+	t.Setenv("BT_EMPTY", "")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string // substring of the error
+	}{
+		{in: "plain $HOME text", want: "plain $HOME text"},
+		{in: "${BT_USER}", want: "backup"},
+		{in: "user=${BT_USER}, again ${BT_USER}", want: "user=backup, again backup"},
+		{in: "[${BT_UNSET}]", want: "[]"},
+		{in: "${BT_USER:-fallback}", want: "backup"},
+		{in: "${BT_UNSET:-fallback}", want: "fallback"},
+		{in: "${BT_EMPTY:-fallback}", want: "fallback"},
+		{in: "${BT_UNSET:-}", want: ""},
+		{in: "${BT_USER:?set BT_USER}", want: "backup"},
+		{in: "${BT_UNSET:?set BT_UNSET}", wantErr: "required variable BT_UNSET: set BT_UNSET"},
+		{in: "${BT_EMPTY:?}", wantErr: "required variable BT_EMPTY: not set"},
+		{in: "$${BT_USER}", want: "${BT_USER}"},
+		{in: "$${BT_USER} is ${BT_USER}", want: "${BT_USER} is backup"},
+		{in: "cost: $5", want: "cost: $5"},
+		{in: "${BT_USER", wantErr: `unterminated "${"`},
+		{in: "${BT_USER} ${", wantErr: `unterminated "${"`},
+		{in: "${}", wantErr: "empty variable name"},
+		{in: "${BT_USER:+alt}", wantErr: "unsupported reference to BT_USER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := expandString(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expandString(%q) = %q, %v, want error containing %q", tt.in, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("expandString(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandEnvNamesField(t *testing.T) {
+	t.Setenv("BT_PASSWORD", "")
+	cfg := Config{DatabaseUsers: map[string]DBUser{
+		"pg": {Password: Secret{Value: "${BT_PASSWORD:?missing}"}},
+	}}
+	err := cfg.ExpandEnv()
+	if err == nil || !strings.HasPrefix(err.Error(), "databaseUsers.pg.password: ") {
+		t.Errorf("ExpandEnv = %v, want an error for databaseUsers.pg.password", err)
+	}
+}
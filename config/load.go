@@ -0,0 +1,278 @@
+// Package config
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+// Load reads the configuration file at path and the fragments its include
+// patterns match, merges them and populates a Config. The format of every file
+// is chosen by its extension: .yaml/.yml, .toml or JSON for any other name.
+// ${VAR} references in string values are expanded from the environment.
+// Unknown keys are returned as problems.
+func Load(path string) (*Config, []Problem, error) {
+	tree, err := readTree(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	problems := checkKeys(tree, reflect.TypeOf(Config{}), "")
+
+	origins := make(map[string]string)
+	fragments, err := includedFiles(path, tree["include"])
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, fragment := range fragments {
+		name := displayPath(path, fragment)
+		frag, err := readTree(fragment)
+		if err != nil {
+			return nil, nil, err
+		}
+		problems = append(problems, prefixProblems(name, checkKeys(frag, reflect.TypeOf(Config{}), ""))...)
+		if err := mergeTree(tree, frag, name, origins); err != nil {
+			return nil, nil, err
+		}
+	}
+	sortProblems(problems)
+
+	// Going through JSON keeps the json tags and Secret.UnmarshalJSON the
+	// only description of the format
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error converting %s: %w", path, err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("error in %s: %w", path, err)
+	}
+	if err := cfg.ExpandEnv(); err != nil {
+		return nil, nil, fmt.Errorf("error in %s: %w", path, err)
+	}
+	cfg.origins = origins
+	return &cfg, problems, nil
+}
+
+// Locate rewrites the paths of problems found in items that came from an
+// included fragment to the file and path they were written at, e.g.
+// dirs[3].path to conf.d/app.yaml: dirs[0].path.
+func (c *Config) Locate(problems []Problem) []Problem {
+	for i, p := range problems {
+		for merged, origin := range c.origins {
+			rest, ok := strings.CutPrefix(p.Path, merged)
+			if ok && (rest == "" || rest[0] == '.' || rest[0] == '[') {
+				problems[i].Path = origin + rest
+				break
+			}
+		}
+	}
+	return problems
+}
+
+// readTree decodes the configuration file at path into generic JSON values.
+func readTree(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file %s: %w", path, err)
+	}
+
+	var raw any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("error parsing YAML in %s: %w", path, err)
+		}
+	case ".toml":
+		var table map[string]any
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, fmt.Errorf("error parsing TOML in %s: %w", path, err)
+		}
+		raw = table
+	default:
+		// .json and any other name (config.json.example, config) are read as JSON
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			if ext != ".json" {
+				return nil, fmt.Errorf("error parsing JSON in %s (files not named .yaml, .yml or .toml are read as JSON): %w", path, err)
+			}
+			return nil, fmt.Errorf("error parsing JSON in %s: %w", path, err)
+		}
+	}
+
+	if raw == nil {
+		return map[string]any{}, nil // empty YAML file
+	}
+	tree, ok := normalize(raw).(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must contain an object at the top level", path)
+	}
+	return tree, nil
+}
+
+// normalize converts YAML maps with non-string keys (e.g. "5432:") and TOML
+// tables into map[string]any so the tree can be encoded as JSON.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			v[key] = normalize(value)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalize(value)
+		}
+		return m
+	case []map[string]any:
+		list := make([]any, len(v))
+		for i, value := range v {
+			list[i] = normalize(value)
+		}
+		return list
+	case []any:
+		for i, value := range v {
+			v[i] = normalize(value)
+		}
+		return v
+	}
+	return v
+}
+
+// includedFiles expands the include patterns of the configuration file at
+// path, relative to its directory, into a sorted list of files. Patterns
+// without wildcards must match a file; the others may match none.
+func includedFiles(path string, include any) ([]string, error) {
+	if include == nil {
+		return nil, nil
+	}
+	list, ok := include.([]any)
+	if !ok {
+		list = []any{include}
+	}
+
+	self, _ := filepath.Abs(path)
+	seen := map[string]bool{self: true}
+	var files []string
+	for _, value := range list {
+		pattern, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("error in %s: include: expected file names or patterns, got %v", path, value)
+		}
+		pattern, err := expandString(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error in %s: include: %w", path, err)
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error in %s: include %q: %w", path, value, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("error in %s: included file %s does not exist", path, pattern)
+		}
+		for _, match := range matches {
+			abs, _ := filepath.Abs(match)
+			if info, err := os.Stat(match); err != nil || info.IsDir() || seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+// mergeTree merges the fragment frag, read from the file name, into tree:
+// lists (dirs, databases, ...) are appended to, maps (databaseUsers) get the
+// new keys, and other settings may only be set in one file. The origins of
+// the merged entries are recorded for Locate.
+func mergeTree(tree, frag map[string]any, name string, origins map[string]string) error {
+	fields := make(map[string]reflect.Type)
+	collectFields(reflect.TypeOf(Config{}), fields)
+
+	keys := make([]string, 0, len(frag))
+	for key := range frag {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := frag[key]
+		if key == "include" {
+			return fmt.Errorf("error in %s: include is only allowed in the main configuration file", name)
+		}
+
+		t, ok := fields[key]
+		switch {
+		case ok && t.Kind() == reflect.Slice:
+			list, ok := value.([]any)
+			if !ok {
+				return fmt.Errorf("error in %s: %s must be a list", name, key)
+			}
+			existing, _ := tree[key].([]any)
+			for i := range list {
+				origins[fmt.Sprintf("%s[%d]", key, len(existing)+i)] = fmt.Sprintf("%s: %s[%d]", name, key, i)
+			}
+			tree[key] = append(existing, list...)
+
+		case ok && t.Kind() == reflect.Map:
+			m, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("error in %s: %s must be an object", name, key)
+			}
+			existing, _ := tree[key].(map[string]any)
+			if existing == nil {
+				existing = make(map[string]any)
+				tree[key] = existing
+			}
+			for k, v := range m {
+				if _, dup := existing[k]; dup {
+					return fmt.Errorf("error in %s: %s.%s is already defined", name, key, k)
+				}
+				existing[k] = v
+				origins[joinPath(key, k)] = fmt.Sprintf("%s: %s", name, joinPath(key, k))
+			}
+
+		default:
+			if _, dup := tree[key]; dup {
+				return fmt.Errorf("error in %s: %s is already set", name, key)
+			}
+			tree[key] = value
+			origins[key] = fmt.Sprintf("%s: %s", name, key)
+		}
+	}
+	return nil
+}
+
+// displayPath returns fragment relative to the directory of the main
+// configuration file, if it is below it.
+func displayPath(main, fragment string) string {
+	if rel, err := filepath.Rel(filepath.Dir(main), fragment); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return fragment
+}
+
+// prefixProblems adds the file name to the paths of problems found in it.
+func prefixProblems(name string, problems []Problem) []Problem {
+	for i, p := range problems {
+		if p.Path == "" {
+			problems[i].Path = name
+		} else {
+			problems[i].Path = name + ": " + p.Path
+		}
+	}
+	return problems
+}
@@ -0,0 +1,134 @@
+// Package config
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Secret is a password or key. In JSON it is either the value itself or a
+// reference that is resolved at startup by ResolveSecrets:
+//
+//	{"file": "/run/secrets/pg"}          contents of the file
+//	{"command": ["pass", "show", "pg"]}  output of the command
+//	{"systemdCredential": "smb"}         $CREDENTIALS_DIRECTORY/smb
+//
+// A trailing newline is removed from files and command output.
+type Secret struct {
+	Value             string   `json:"-"` // the secret itself, once resolved
+	File              string   `json:"file,omitempty"`
+	Command           []string `json:"command,omitempty"`
+	SystemdCredential string   `json:"systemdCredential,omitempty"`
+}
+
+// secretType is the reflect.Type of Secret.
+var secretType = reflect.TypeOf(Secret{})
+
+// String keeps secrets out of logs when a Secret is printed by mistake.
+func (s Secret) String() string {
+	if !s.IsSet() {
+		return ""
+	}
+	return "****"
+}
+
+// IsSet reports whether a value or a reference is given.
+func (s Secret) IsSet() bool {
+	return s.Value != "" || s.isRef()
+}
+
+// UnmarshalJSON accepts a string or a reference object.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*s = Secret{Value: value}
+		return nil
+	}
+
+	// ref has the fields of Secret but not its methods
+	type ref Secret
+	var r ref
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("secret must be a string or an object with file, command or systemdCredential")
+	}
+	refs := 0
+	for _, set := range []bool{r.File != "", len(r.Command) > 0, r.SystemdCredential != ""} {
+		if set {
+			refs++
+		}
+	}
+	if refs != 1 {
+		return fmt.Errorf("secret must have exactly one of file, command or systemdCredential")
+	}
+	*s = Secret(r)
+	return nil
+}
+
+// isRef reports whether s refers to a file, command or credential.
+func (s Secret) isRef() bool {
+	return s.File != "" || len(s.Command) > 0 || s.SystemdCredential != ""
+}
+
+// resolve reads the value of a reference.
+func (s *Secret) resolve() error {
+	var data []byte
+	var err error
+	switch {
+	case s.File != "":
+		if data, err = os.ReadFile(s.File); err != nil {
+			return fmt.Errorf("failed to read secret: %w", err)
+		}
+	case len(s.Command) > 0:
+		if data, err = exec.Command(s.Command[0], s.Command[1:]...).Output(); err != nil {
+			return fmt.Errorf("secret command %s failed: %w", s.Command[0], err)
+		}
+	case s.SystemdCredential != "":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return fmt.Errorf("systemd credential %s: CREDENTIALS_DIRECTORY is not set (use LoadCredential= in the service)", s.SystemdCredential)
+		}
+		if strings.ContainsRune(s.SystemdCredential, '/') {
+			return fmt.Errorf("invalid systemd credential name %q", s.SystemdCredential)
+		}
+		if data, err = os.ReadFile(filepath.Join(dir, s.SystemdCredential)); err != nil {
+			return fmt.Errorf("failed to read systemd credential: %w", err)
+		}
+	default:
+		return nil
+	}
+	s.Value = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
+
+// ResolveSecrets reads every Secret of the configuration that refers to a
+// file, command or systemd credential. Errors name the field by its JSON path
+// and never contain secret values.
+func (c *Config) ResolveSecrets() error {
+	return walkConfig(reflect.ValueOf(c).Elem(), "", func(v reflect.Value, path string) error {
+		if v.Type() != secretType {
+			return nil
+		}
+		if err := v.Addr().Interface().(*Secret).resolve(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// SecretValues returns the values of all secrets in the configuration, e.g.
+// to redact them from output.
+func (c *Config) SecretValues() []string {
+	var values []string
+	walkConfig(reflect.ValueOf(c).Elem(), "", func(v reflect.Value, path string) error {
+		if v.Type() == secretType && v.FieldByName("Value").String() != "" {
+			values = append(values, v.FieldByName("Value").String())
+		}
+		return nil
+	})
+	return values
+}
@@ -0,0 +1,105 @@
+// Package config
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Problem is a mistake found in the configuration.
+type Problem struct {
+	Path    string // JSON path, e.g. databases[1].userRef
+	Message string
+	Warning bool // runs can go ahead despite it
+}
+
+// String formats the problem as "path: message".
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// sortProblems orders problems by path; keys of decoded objects come in
+// random order.
+func sortProblems(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Path != problems[j].Path {
+			return problems[i].Path < problems[j].Path
+		}
+		return problems[i].Message < problems[j].Message
+	})
+}
+
+// checkKeys reports the keys of the decoded configuration value raw that do
+// not match a field of the type t it is unmarshalled into exactly.
+// json.Unmarshal ignores unknown keys and matches the others
+// case-insensitively, so typos like "userref" go unnoticed otherwise.
+func checkKeys(raw any, t reflect.Type, path string) []Problem {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var problems []Problem
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]any)
+		if !ok {
+			// Secrets may be plain strings; type mismatches are reported by
+			// json.Unmarshal
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		collectFields(t, fields)
+		for key, value := range obj {
+			if ft, ok := fields[key]; ok {
+				problems = append(problems, checkKeys(value, ft, joinPath(path, key))...)
+				continue
+			}
+			message := fmt.Sprintf("unknown key %q", key)
+			for name := range fields {
+				if strings.EqualFold(name, key) {
+					message += fmt.Sprintf(" (did you mean %q?)", name)
+					break
+				}
+			}
+			problems = append(problems, Problem{Path: path, Message: message})
+		}
+
+	case reflect.Slice, reflect.Array:
+		if list, ok := raw.([]any); ok {
+			for i, value := range list {
+				problems = append(problems, checkKeys(value, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+
+	case reflect.Map:
+		if obj, ok := raw.(map[string]any); ok {
+			for key, value := range obj {
+				problems = append(problems, checkKeys(value, t.Elem(), joinPath(path, key))...)
+			}
+		}
+	}
+	return problems
+}
+
+// collectFields adds the JSON names of the fields of struct type t, including
+// those of embedded structs, to fields.
+func collectFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			collectFields(field.Type, fields)
+			continue
+		}
+		if name := jsonName(field); name != "-" {
+			fields[name] = field.Type
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// config_cmd.go
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"backup-tool/backup"
+	"backup-tool/config"
+)
+
+// runConfig implements "backup-tool config validate": it checks the
+// configuration, including source paths and secrets, and lists every problem.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Println("Usage: backup-tool config validate [-config FILE] [-env FILE]")
+		exit(2)
+	}
+
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file (.json, .yaml or .toml)")
+	envPath := fs.String("env", ".env", "Path to .env file (optional)")
+	fs.Parse(args[1:])
+
+	loadEnv(*envPath)
+	cfg, problems, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		exit(1)
+	}
+	problems = append(problems, cfg.Locate(backup.Validate(cfg, true))...)
+	if err := cfg.ResolveSecrets(); err != nil {
+		problems = append(problems, config.Problem{Message: err.Error()})
+	}
+
+	errorCount := printProblems(problems)
+	switch {
+	case errorCount > 0:
+		fmt.Printf("❌ %s is invalid (errors: %d, warnings: %d)\n", *configPath, errorCount, len(problems)-errorCount)
+		exit(1)
+	case len(problems) > 0:
+		fmt.Printf("✅ %s is valid (warnings: %d)\n", *configPath, len(problems))
+	default:
+		fmt.Printf("✅ %s is valid\n", *configPath)
+	}
+}
@@ -2,112 +2,206 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"runtime/debug"
 
 	"backup-tool/backup"
 	"backup-tool/config"
+	"backup-tool/utils"
 	"github.com/joho/godotenv"
 )
 
+// restoreOutput ends the redaction of secrets started by setup.
+var restoreOutput = func() {}
+
 func main() {
-	configPath := flag.String("config", "config.json", "Path to configuration file")
-	envPath := flag.String("env", ".env", "Path to .env file (optional)")
-	flag.Parse()
-
-	// Load .env file if it exists
-	if _, err := os.Stat(*envPath); err == nil {
-		if err := godotenv.Load(*envPath); err != nil {
-			fmt.Printf("⚠️ Error loading %s: %v\n", *envPath, err)
-		} else {
-			fmt.Printf("✅ Loaded .env file: %s\n", *envPath)
+	defer func() {
+		// The runtime prints panics to the terminal directly, around the
+		// redaction; print them through it instead
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "panic: %v\n\n%s", r, debug.Stack())
+			exit(2)
+		}
+		restoreOutput()
+	}()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "restore-db":
+			runRestoreDB(os.Args[2:])
+			return
+		case "prune":
+			runPrune(os.Args[2:])
+			return
+		case "config":
+			runConfig(os.Args[2:])
+			return
 		}
 	}
 
-	// Load configuration with environment variable substitution
-	cfg, err := loadConfig(*configPath)
-	if err != nil {
-		panic(fmt.Errorf("error loading configuration: %w", err))
+	fs := flag.NewFlagSet("backup-tool", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file (.json, .yaml or .toml)")
+	envPath := fs.String("env", ".env", "Path to .env file (optional)")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be archived, uploaded and deleted")
+	fs.Parse(os.Args[1:])
+
+	cfg := setup(*configPath, *envPath, true)
+
+	if *dryRun {
+		printDryRunPlan(cfg)
+	} else if err := os.MkdirAll(cfg.LocalBackupPath, 0755); err != nil {
+		// Create root backup directory
+		fmt.Printf("❌ Failed to create %s: %v\n", cfg.LocalBackupPath, err)
+		exit(1)
+	}
+
+	// Backups used to be stored under the base name of each item's path
+	if err := backup.MigrateLayout(cfg, *dryRun); err != nil {
+		fmt.Printf("⚠️ %v\n", err)
 	}
 
-	// Create root backup directory
-	if err := os.MkdirAll(cfg.LocalBackupPath, 0755); err != nil {
-		panic(fmt.Errorf("failed to create %s: %w", cfg.LocalBackupPath, err))
+	// Archives and chunks of interrupted runs are written under temporary names
+	if err := backup.RemoveStaleTemps(cfg.LocalBackupPath, *dryRun); err != nil {
+		fmt.Printf("⚠️ %v\n", err)
 	}
 
 	// === 1. Backups ===
-	if err := backup.BackupDirs(cfg.LocalBackupPath, cfg.Dirs); err != nil {
+	summary := &backup.Summary{}
+	opts := backup.ArchiveOptions{Compression: cfg.Compression, Encryption: cfg.Encryption, DryRun: *dryRun}
+	if err := backup.BackupDirs(cfg.LocalBackupPath, cfg.Dirs, opts, summary); err != nil {
 		fmt.Printf("⚠️ Error backing up directories: %v\n", err)
 	}
-	if err := backup.BackupFiles(cfg.LocalBackupPath, cfg.Files); err != nil {
+	if err := backup.BackupFiles(cfg.LocalBackupPath, cfg.Files, opts, summary); err != nil {
 		fmt.Printf("⚠️ Error backing up files: %v\n", err)
 	}
-	if err := backup.BackupLogs(cfg.LocalBackupPath, cfg.Logs); err != nil {
+	if err := backup.BackupLogs(cfg.LocalBackupPath, cfg.Logs, opts, summary); err != nil {
 		fmt.Printf("⚠️ Error backing up logs: %v\n", err)
 	}
-	if err := backup.BackupDatabases(cfg.LocalBackupPath, cfg.Databases, cfg.DatabaseUsers); err != nil {
+	if err := backup.BackupDatabases(cfg.LocalBackupPath, cfg.Databases, cfg.DatabaseUsers, opts, summary); err != nil {
 		fmt.Printf("❌ Error backing up databases: %v\n", err)
 	}
 
-	// === 2. Upload to SMB + Cleanup on SMB ===
-	if cfg.Upload.Active {
-		// Upload ALL contents of LocalBackupPath to SMB
-		if err := backup.UploadToSMB(cfg.LocalBackupPath, cfg.Upload); err != nil {
-			fmt.Printf("⚠️ Error uploading to SMB: %v\n", err)
-		}
+	// === 2. Upload + Cleanup on every destination ===
+	dests := cfg.RemoteDestinations()
+	if len(dests) > 0 {
+		// Items and their retention for remote cleanup
+		remoteItems := backup.RemoteItems(cfg, summary)
 
-		// Prepare list of items for cleanup on SMB
-		var smbItems []backup.SMBItem
+		for _, dest := range dests {
+			// Upload ALL contents of LocalBackupPath to the destination
+			if err := backup.UploadToDestination(cfg.LocalBackupPath, dest, cfg.Encryption, *dryRun, summary); err != nil {
+				fmt.Printf("⚠️ Error uploading to %s: %v\n", dest.Name, err)
+			}
 
-		for _, dir := range cfg.Dirs {
-			smbItems = append(smbItems, backup.SMBItem{
-				Prefix:   "dir_" + filepath.Base(dir.Path),
-				Lifetime: dir.Lifetime,
-			})
-		}
-		for _, file := range cfg.Files {
-			smbItems = append(smbItems, backup.SMBItem{
-				Prefix:   "file_" + filepath.Base(file.Path),
-				Lifetime: file.Lifetime,
-			})
-		}
-		for _, logItem := range cfg.Logs {
-			smbItems = append(smbItems, backup.SMBItem{
-				Prefix:   "log_" + filepath.Base(logItem.Path),
-				Lifetime: logItem.Lifetime,
-			})
-		}
-		for _, db := range cfg.Databases {
-			smbItems = append(smbItems, backup.SMBItem{
-				Prefix:   "db_" + db.Name,
-				Lifetime: db.Lifetime,
-			})
+			// Clean up old backups on the destination
+			if err := backup.CleanupDestination(dest, remoteItems, cfg.Encryption, *dryRun); err != nil {
+				fmt.Printf("⚠️ Error cleaning up %s: %v\n", dest.Name, err)
+			}
+
+			// Keep the destination within its size limit
+			if dest.MaxTotalSize != "" {
+				if err := backup.EnforceDestinationQuota(cfg, dest, summary, *dryRun); err != nil {
+					fmt.Printf("⚠️ Error enforcing maxTotalSize on %s: %v\n", dest.Name, err)
+				}
+			}
 		}
+	}
 
-		// Clean up old backups on SMB
-		if err := backup.CleanupSMB(cfg.Upload, smbItems); err != nil {
-			fmt.Printf("⚠️ Error cleaning up SMB: %v\n", err)
+	// === 3. Size limit of the local backup root ===
+	if cfg.MaxTotalSize != "" {
+		if err := backup.EnforceLocalQuota(cfg, summary, *dryRun); err != nil {
+			fmt.Printf("⚠️ Error enforcing maxTotalSize on %s: %v\n", cfg.LocalBackupPath, err)
 		}
 	}
 
+	summary.Print()
+	if *dryRun {
+		fmt.Println("✅ Dry run completed, nothing was changed.")
+		return
+	}
 	fmt.Println("✅ All tasks completed.")
 }
 
-// loadConfig reads JSON configuration from disk and populates config.Config structure.
-// Environment variable substitution can be added here if needed.
-func loadConfig(path string) (*config.Config, error) {
-	data, err := os.ReadFile(path)
+// printDryRunPlan shows the resolved configuration a dry run works with.
+func printDryRunPlan(cfg *config.Config) {
+	fmt.Println("🔍 Dry run: nothing will be archived, truncated, uploaded or deleted")
+	if _, err := os.Stat(cfg.LocalBackupPath); os.IsNotExist(err) {
+		fmt.Printf("🔍 Would create %s\n", cfg.LocalBackupPath)
+	} else {
+		fmt.Printf("🔍 Backup root: %s\n", cfg.LocalBackupPath)
+	}
+	fmt.Printf("🔍 Items: %d directories, %d files, %d logs, %d databases\n", len(cfg.Dirs), len(cfg.Files), len(cfg.Logs), len(cfg.Databases))
+	for _, dest := range cfg.RemoteDestinations() {
+		fmt.Printf("🔍 Destination %s (%s)\n", dest.Name, dest.Type)
+	}
+}
+
+// setup loads the optional .env file and the configuration and stops if the
+// configuration is invalid (checkSources includes the source paths of the
+// items). It then resolves the secrets and keeps their values out of
+// everything printed from then on.
+func setup(configPath, envPath string, checkSources bool) *config.Config {
+	loadEnv(envPath)
+
+	// Load configuration with environment variable substitution
+	cfg, problems, err := config.Load(configPath)
+	if err != nil {
+		fmt.Printf("❌ Error loading configuration: %v\n", err)
+		exit(1)
+	}
+	problems = append(problems, cfg.Locate(backup.Validate(cfg, checkSources))...)
+	if errorCount := printProblems(problems); errorCount > 0 {
+		fmt.Printf("❌ %s is invalid (errors: %d), nothing was done\n", configPath, errorCount)
+		exit(1)
+	}
+
+	if err := cfg.ResolveSecrets(); err != nil {
+		fmt.Printf("❌ Error resolving secrets in %s: %v\n", configPath, err)
+		exit(1)
+	}
+	restore, err := utils.RedactOutput(cfg.SecretValues())
 	if err != nil {
-		return nil, fmt.Errorf("failed to read configuration file %s: %w", path, err)
+		// Without redaction, secrets could end up in logs
+		fmt.Printf("❌ Error setting up redaction of secrets: %v\n", err)
+		exit(1)
 	}
+	restoreOutput = restore
+	return cfg
+}
 
-	var cfg config.Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("error parsing JSON in %s: %w", path, err)
+// loadEnv loads the .env file at envPath, if it exists.
+func loadEnv(envPath string) {
+	if _, err := os.Stat(envPath); err == nil {
+		if err := godotenv.Load(envPath); err != nil {
+			fmt.Printf("⚠️ Error loading %s: %v\n", envPath, err)
+		} else {
+			fmt.Printf("✅ Loaded .env file: %s\n", envPath)
+		}
 	}
+}
+
+// printProblems lists problems found in the configuration and returns the
+// number of errors among them.
+func printProblems(problems []config.Problem) int {
+	errorCount := 0
+	for _, p := range problems {
+		if p.Warning {
+			fmt.Printf("⚠️ %s\n", p)
+			continue
+		}
+		fmt.Printf("❌ %s\n", p)
+		errorCount++
+	}
+	return errorCount
+}
 
-	return &cfg, nil
+// exit writes any pending output and ends the program with code.
+func exit(code int) {
+	restoreOutput()
+	os.Exit(code)
 }
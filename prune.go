@@ -0,0 +1,27 @@
+// prune.go
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"backup-tool/backup"
+)
+
+// runPrune implements "backup-tool prune": it applies retention locally and on
+// every destination without taking backups.
+func runPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file (.json, .yaml or .toml)")
+	envPath := fs.String("env", ".env", "Path to .env file (optional)")
+	dryRun := fs.Bool("dry-run", false, "Only show which backups each rule keeps and what would be deleted")
+	fs.Parse(args)
+
+	cfg := setup(*configPath, *envPath, false)
+
+	if err := backup.Prune(cfg, *dryRun); err != nil {
+		fmt.Printf("❌ Prune failed: %v\n", err)
+		exit(1)
+	}
+	fmt.Println("✅ Prune completed.")
+}
@@ -0,0 +1,87 @@
+// restore.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"backup-tool/backup"
+	"backup-tool/config"
+	"backup-tool/utils"
+)
+
+// runRestore implements "backup-tool restore": it extracts a dir/file/log
+// archive back into a target directory.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file (.json, .yaml or .toml)")
+	envPath := fs.String("env", ".env", "Path to .env file (optional)")
+	kind := fs.String("kind", "dir", "Kind of backup to restore: dir, file or log")
+	name := fs.String("name", "", "Item name, or the backed up path")
+	at := fs.String("at", "", "Restore the newest archive taken at or before this time (default: now)")
+	target := fs.String("target", "", "Directory to extract the archive into")
+	force := fs.Bool("force", false, "Overwrite existing files in the target directory")
+	fs.Parse(args)
+
+	if *name == "" || *target == "" {
+		fmt.Println("Usage: backup-tool restore --kind dir|file|log --name NAME --target DIR [--at TIME] [--force]")
+		exit(2)
+	}
+
+	restoreAt := time.Now()
+	if *at != "" {
+		t, err := utils.ParseTimeArg(*at)
+		if err != nil {
+			fmt.Printf("❌ Invalid --at value: %v\n", err)
+			exit(2)
+		}
+		restoreAt = t
+	}
+
+	cfg := setup(*configPath, *envPath, false)
+
+	opts := backup.RestoreOptions{
+		Kind:       *kind,
+		Name:       itemName(cfg, *kind, *name),
+		At:         restoreAt,
+		Target:     *target,
+		Force:      *force,
+		Encryption: cfg.Encryption,
+	}
+	if err := backup.RestoreArchive(cfg.LocalBackupPath, cfg.RemoteDestinations(), opts); err != nil {
+		fmt.Printf("❌ Restore failed: %v\n", err)
+		exit(1)
+	}
+}
+
+// itemName returns the name of the configured item of the given kind that
+// name refers to, by its name, its path or the base name of its path (the
+// name of backups taken before items had names). Other names are returned as
+// they are.
+func itemName(cfg *config.Config, kind, name string) string {
+	var items []config.Item
+	switch kind {
+	case "dir":
+		items = cfg.Dirs
+	case "file":
+		items = cfg.Files
+	case "log":
+		items = cfg.Logs
+	}
+	for _, item := range items {
+		if item.BackupName() == name || item.Path == name {
+			return item.BackupName()
+		}
+	}
+	var matches []string
+	for _, item := range items {
+		if item.LegacyName() == name {
+			matches = append(matches, item.BackupName())
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	return name
+}
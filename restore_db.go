@@ -0,0 +1,72 @@
+// restore_db.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"backup-tool/backup"
+	"backup-tool/config"
+	"backup-tool/utils"
+)
+
+// runRestoreDB implements "backup-tool restore-db": it restores a database dump
+// using the connection profile referenced by the database entry in the config.
+func runRestoreDB(args []string) {
+	fs := flag.NewFlagSet("restore-db", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file (.json, .yaml or .toml)")
+	envPath := fs.String("env", ".env", "Path to .env file (optional)")
+	name := fs.String("name", "", "Database name as listed in the configuration")
+	at := fs.String("at", "", "Restore the newest dump taken at or before this time (default: now)")
+	into := fs.String("into", "", "Restore into a differently named database")
+	drop := fs.Bool("drop", false, "Drop and recreate the target database before restoring")
+	dryRun := fs.Bool("dry-run", false, "Only print the commands that would be run")
+	fs.Parse(args)
+
+	if *name == "" {
+		fmt.Println("Usage: backup-tool restore-db --name DB [--at TIME] [--into NAME] [--drop] [--dry-run]")
+		exit(2)
+	}
+
+	restoreAt := time.Now()
+	if *at != "" {
+		t, err := utils.ParseTimeArg(*at)
+		if err != nil {
+			fmt.Printf("❌ Invalid --at value: %v\n", err)
+			exit(2)
+		}
+		restoreAt = t
+	}
+
+	cfg := setup(*configPath, *envPath, false)
+
+	var db *config.Database
+	for i := range cfg.Databases {
+		if cfg.Databases[i].Name == *name {
+			db = &cfg.Databases[i]
+			break
+		}
+	}
+	if db == nil {
+		fmt.Printf("❌ Database %s is not listed in %s\n", *name, *configPath)
+		exit(1)
+	}
+	user, exists := cfg.DatabaseUsers[db.UserRef]
+	if !exists {
+		fmt.Printf("❌ databaseUsers.%s not found for database %s\n", db.UserRef, db.Name)
+		exit(1)
+	}
+
+	opts := backup.DBRestoreOptions{
+		At:         restoreAt,
+		Into:       *into,
+		Drop:       *drop,
+		DryRun:     *dryRun,
+		Encryption: cfg.Encryption,
+	}
+	if err := backup.RestoreDatabase(cfg.LocalBackupPath, cfg.RemoteDestinations(), *db, user, opts); err != nil {
+		fmt.Printf("❌ Database restore failed: %v\n", err)
+		exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+// utils/redact.go
+package utils
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// minRedactLength is the length below which secrets are not redacted, since
+// replacing every occurrence of a one- or two-letter string garbles the output.
+const minRedactLength = 3
+
+// RedactOutput replaces every occurrence of secrets in what is written to
+// os.Stdout, os.Stderr and the standard logger from now on with "****".
+// Output passes through line by line. The returned function restores both
+// files once all pending output is written; it must be called before the
+// program exits.
+func RedactOutput(secrets []string) (func(), error) {
+	var pairs []string
+	sorted := append([]string(nil), secrets...)
+	// Longer secrets first, so a secret containing another is replaced whole
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, s := range sorted {
+		if len(s) >= minRedactLength {
+			pairs = append(pairs, s, "****")
+		}
+	}
+	if len(pairs) == 0 {
+		return func() {}, nil
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	restoreStdout, err := redirect(&os.Stdout, replacer)
+	if err != nil {
+		return nil, err
+	}
+	restoreStderr, err := redirect(&os.Stderr, replacer)
+	if err != nil {
+		restoreStdout()
+		return nil, err
+	}
+	log.SetOutput(os.Stderr)
+
+	return func() {
+		restoreStderr()
+		log.SetOutput(os.Stderr)
+		restoreStdout()
+	}, nil
+}
+
+// redirect replaces *file with a pipe whose lines are written to the
+// original file after passing through replacer. The returned function puts
+// the original file back once the pipe is drained.
+func redirect(file **os.File, replacer *strings.Replacer) (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	original := *file
+	*file = w
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				io.WriteString(original, replacer.Replace(line))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		*file = original
+		w.Close()
+		<-done
+		r.Close()
+	}, nil
+}
@@ -0,0 +1,52 @@
+// utils/size.go
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits maps unit suffixes to their factor. Units are binary, so "1G" and
+// "1GB" both mean 1024³ bytes, like "1GiB".
+var sizeUnits = map[string]float64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+// ParseSize parses a size such as "500M", "20GB", "1.5TiB" or a plain number
+// of bytes.
+func ParseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.TrimSpace(s[i:])
+
+	n, err := strconv.ParseFloat(number, 64)
+	factor, ok := sizeUnits[unit]
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 500M, 20GB or 1.5TiB)", value)
+	}
+	return int64(n * factor), nil
+}
+
+// FormatSize formats a number of bytes with a binary unit, e.g. "1.5 GiB".
+func FormatSize(bytes int64) string {
+	if bytes < 1<<10 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value := float64(bytes)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= 1024
+		if value < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return ""
+}
@@ -2,20 +2,33 @@
 package utils
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"time"
 )
 
-var timestampRegex = regexp.MustCompile(`_(\d{8}_\d{6})\.tar\.gz$`)
+// TimestampLayout is the layout of the timestamp embedded in archive names.
+const TimestampLayout = "20060102_150405"
 
+// timestampRegex matches archive names with any supported compression
+// (.tar, .tar.gz, .tar.zst, .tar.xz), including encrypted ones (.age/.enc).
+var timestampRegex = regexp.MustCompile(`_(\d{8}_\d{6})\.tar(\.gz|\.zst|\.xz)?(\.age|\.enc)?$`)
+
+// IsArchiveName reports whether filename is a (possibly encrypted) backup archive.
+func IsArchiveName(filename string) bool {
+	return timestampRegex.MatchString(filename)
+}
+
+// GetBackupTimeFromName extracts the creation time from an archive name.
+// Archive names are formatted with local time, so they are parsed in time.Local.
 func GetBackupTimeFromName(filename string) (time.Time, bool) {
 	matches := timestampRegex.FindStringSubmatch(filename)
 	if len(matches) < 2 {
 		return time.Time{}, false
 	}
-	t, err := time.Parse("20060102_150405", matches[1])
+	t, err := time.ParseInLocation(TimestampLayout, matches[1], time.Local)
 	return t, err == nil
 }
 
@@ -30,3 +43,21 @@ func IsBackupOlderThan(fullPath string, days int) bool {
 	}
 	return backupTime.Before(time.Now().AddDate(0, 0, -days))
 }
+
+// ParseTimeArg parses a point in time given on the command line.
+// A bare date means the end of that day, so "--at 2026-10-01" includes
+// every backup taken on October 1st.
+func ParseTimeArg(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", TimestampLayout} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q (expected YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC 3339)", value)
+}